@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// isLifecycleStateLeaving reports whether an auto scaling instance is on its
+// way out of the group (Terminating*, Terminated, Detaching, Detached).
+func isLifecycleStateLeaving(lifecycleState string) bool {
+	return strings.HasPrefix(lifecycleState, "Terminat") ||
+		strings.HasPrefix(lifecycleState, "Detach")
+}
+
+func getAutoScalingInstanceIDs(rc *regionClient, groupName string) ([]*string, error) {
+
+	var instanceIDs []*string
+
+	err := rc.autoScalingClient.DescribeAutoScalingGroupsPages(&autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{aws.String(groupName)},
+	}, func(output *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
+		for _, group := range output.AutoScalingGroups {
+			for _, instance := range group.Instances {
+				if isLifecycleStateLeaving(*instance.LifecycleState) {
+					log.Printf("skipping instance %v in lifecycle state %v\n",
+						*instance.InstanceId, *instance.LifecycleState)
+					continue
+				}
+				instanceIDs = append(instanceIDs, instance.InstanceId)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return instanceIDs, nil
+}
+
+func getInstanceListFromAutoScalingGroup(rc *regionClient, opts *discoveryOptions, groupName string) ([]*internalInstance, error) {
+
+	var instances []*internalInstance
+
+	instanceIDs, err := getAutoScalingInstanceIDs(rc, groupName)
+	if err != nil {
+		return nil, err
+	}
+	// an empty id list would make DescribeInstances return every instance
+	if len(instanceIDs) == 0 {
+		return instances, nil
+	}
+
+	reservations, err := describeInstances(rc, opts, &ec2.DescribeInstancesInput{
+		InstanceIds: instanceIDs,
+		Filters:     opts.instanceFilters(),
+	}, groupName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, reservation := range reservations {
+		for _, instance := range reservation.Instances {
+			if opts.isInstanceActive(instance) && opts.inNetwork(instance) {
+				instanceObj := newInternalInstance(instance, rc.region)
+
+				log.Println("found instance: ", *instanceObj)
+				instances = append(instances, instanceObj)
+			}
+		}
+	}
+
+	return instances, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// backendsJSON is the document written to BACKENDS_JSON_DEST. Fields are
+// only ever added to it, so consumers can rely on the existing ones.
+type backendsJSON struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Backends    []backendJSONItem `json:"backends"`
+}
+
+type backendJSONItem struct {
+	Name    string           `json:"name"`
+	Service string           `json:"service"`
+	Servers []serverJSONItem `json:"servers"`
+}
+
+type serverJSONItem struct {
+	Name       string `json:"name"`
+	InstanceID string `json:"instance_id"`
+	IP         string `json:"ip"`
+	DNS        string `json:"dns"`
+	Address    string `json:"address"`
+	Disabled   bool   `json:"disabled"`
+}
+
+func newBackendsJSON(data templateData) backendsJSON {
+	doc := backendsJSON{
+		GeneratedAt: data.GeneratedAt,
+		Backends:    []backendJSONItem{},
+	}
+	for _, backend := range data.Backends {
+		item := backendJSONItem{
+			Name:    backend.Name,
+			Service: backend.Service,
+			Servers: []serverJSONItem{},
+		}
+		for _, server := range backend.Servers {
+			item.Servers = append(item.Servers, serverJSONItem{
+				Name:       server.Name,
+				InstanceID: server.InstanceID,
+				IP:         server.PrivateIP,
+				DNS:        server.PrivateDNS,
+				Address:    server.Address,
+				Disabled:   server.Disabled,
+			})
+		}
+		doc.Backends = append(doc.Backends, item)
+	}
+	return doc
+}
+
+// writeBackendsJSON writes the backends of the rendered config as JSON, from
+// the same data the templates were rendered with.
+func writeBackendsJSON(w *configWriter, dest string, data templateData) error {
+	content, err := json.MarshalIndent(newBackendsJSON(data), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(w, dest, append(content, '\n'))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testBackendsJSON is the schema consumers rely on, fields may only be added.
+const testBackendsJSON = `{
+  "generated_at": "2020-01-02T03:04:05Z",
+  "backends": [
+    {
+      "name": "web",
+      "service": "default",
+      "servers": [
+        {
+          "name": "web-1",
+          "instance_id": "i-1",
+          "ip": "10.0.0.1",
+          "dns": "ip-10-0-0-1.ec2.internal",
+          "address": "10.0.0.1:80",
+          "disabled": false
+        },
+        {
+          "name": "web-2",
+          "instance_id": "i-2",
+          "ip": "10.0.0.2",
+          "dns": "ip-10-0-0-2.ec2.internal",
+          "address": "10.0.0.2:80",
+          "disabled": true
+        }
+      ]
+    },
+    {
+      "name": "empty",
+      "service": "default",
+      "servers": []
+    }
+  ]
+}
+`
+
+func TestWriteBackendsJSON(t *testing.T) {
+	data := testTemplateData()
+	servers := data.Backends[0].Servers[:2]
+	servers[0].PrivateIP, servers[0].PrivateDNS = "10.0.0.1", "ip-10-0-0-1.ec2.internal"
+	servers[1].PrivateIP, servers[1].PrivateDNS = "10.0.0.2", "ip-10-0-0-2.ec2.internal"
+	data.Backends[0].Servers = servers
+
+	dir, err := ioutil.TempDir("", "backends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "backends.json")
+	w := &configWriter{ownership: &fileOwnership{uid: -1, gid: -1}}
+	err = writeBackendsJSON(w, dest, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != testBackendsJSON {
+		t.Errorf("backends json =\n%v\nwant\n%v", string(content), testBackendsJSON)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("temporary files left next to the backends json: %v", len(files)-1)
+	}
+}
+
+func TestBackendsJSONWithoutBackends(t *testing.T) {
+	doc := newBackendsJSON(templateData{})
+	if doc.Backends == nil {
+		t.Error("backends is null instead of an empty list")
+	}
+}
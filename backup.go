@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	defaultBackupCount = 3
+	backupTimeFormat   = "20060102T150405.000000000"
+)
+
+// backupCount returns how many backups of the config are kept.
+func (e *env) backupCount() int {
+	if e.HaproxyBackupCount > 0 {
+		return e.HaproxyBackupCount
+	}
+	return defaultBackupCount
+}
+
+// backupConfig copies the current config to a timestamped .bak file next to
+// it and removes all but the newest keep backups. It returns the path of the
+// backup, or "" when there's no config yet.
+func backupConfig(haproxyFileDest string, keep int) (string, error) {
+	current, err := ioutil.ReadFile(haproxyFileDest)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		log.Println("error when reading config for backup: ", err)
+		return "", err
+	}
+
+	backup := haproxyFileDest + ".bak." + time.Now().UTC().Format(backupTimeFormat)
+	err = ioutil.WriteFile(backup, current, configFileMode(haproxyFileDest))
+	if err != nil {
+		log.Println("error when writing config backup: ", err)
+		return "", err
+	}
+
+	backups, err := filepath.Glob(haproxyFileDest + ".bak.*")
+	if err != nil {
+		return backup, nil
+	}
+	// the timestamps sort lexically, oldest first
+	sort.Strings(backups)
+	for len(backups) > keep {
+		err = os.Remove(backups[0])
+		if err != nil {
+			log.Println("error when removing old config backup: ", err)
+		}
+		backups = backups[1:]
+	}
+	return backup, nil
+}
+
+// restoreConfig puts a backup back in place, replacing the config
+// atomically like writeHaproxyConfig does.
+func restoreConfig(w *configWriter, backup, haproxyFileDest string) error {
+	content, err := ioutil.ReadFile(backup)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(w, haproxyFileDest, content)
+}
+
+// writeFileAtomic writes content to a temporary file next to dest and
+// renames it over dest.
+func writeFileAtomic(w *configWriter, dest string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".")
+	if err != nil {
+		return err
+	}
+	// a no-op once the file is renamed
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(content)
+	if err == nil {
+		err = w.ownership.apply(f, dest)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), dest)
+}
+
+// rollbackConfig restores the backups, keyed by destination, after a failed
+// reload and reloads haproxy again. The returned error says which config is
+// in place.
+func rollbackConfig(w *configWriter, backups map[string]string, environ *env, reloadErr error, rc reloadContext) error {
+	restored := 0
+	for dest, backup := range backups {
+		if backup == "" {
+			continue
+		}
+		log.Println("reload failed, rolling back to: ", backup)
+		err := restoreConfig(w, backup, dest)
+		if err != nil {
+			log.Println("error when restoring config backup: ", err)
+			return fmt.Errorf("reload failed and rollback failed, new config left in place: %v", reloadErr)
+		}
+		restored++
+	}
+	if restored == 0 {
+		return fmt.Errorf("reload failed, no previous config to roll back to: %v", reloadErr)
+	}
+	rc.reason = "rollback"
+	err := reloadHaproxy(environ, rc)
+	if err != nil {
+		return fmt.Errorf("reload failed, rolled back to previous config but its reload failed too: %v", err)
+	}
+	return fmt.Errorf("reload failed, rolled back to previous config: %v", reloadErr)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// permissionError names the IAM permission a failed bootstrap call needs.
+func permissionError(permission string, err error) error {
+	return fmt.Errorf("%v failed, check that the %v permission is granted: %v", permission, permission, err)
+}
+
+// bootstrapQueue makes sure the queue exists, accepts messages from the topic
+// and is subscribed to it. Every step checks what exists first, so it's safe
+// to run on every start. It returns the queue URL and the subscription ARN.
+func bootstrapQueue(sqsClient *sqs.SQS, snsClient *sns.SNS, queueName string, environ *env) (*string, string, error) {
+	queueURL, err := getQueueURL(sqsClient, queueName, "")
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == sqs.ErrCodeQueueDoesNotExist {
+		output, err := sqsClient.CreateQueue(&sqs.CreateQueueInput{
+			QueueName: aws.String(queueName),
+		})
+		if err != nil {
+			return nil, "", permissionError("sqs:CreateQueue", err)
+		}
+		queueURL = output.QueueUrl
+		log.Println("bootstrap: created queue: ", *queueURL)
+	} else if err != nil {
+		return nil, "", permissionError("sqs:GetQueueUrl", err)
+	} else {
+		log.Println("bootstrap: found queue: ", *queueURL)
+	}
+
+	attributes, err := sqsClient.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl: queueURL,
+		AttributeNames: []*string{
+			aws.String(sqs.QueueAttributeNameQueueArn),
+			aws.String(sqs.QueueAttributeNamePolicy),
+		},
+	})
+	if err != nil {
+		return nil, "", permissionError("sqs:GetQueueAttributes", err)
+	}
+	queueArn := aws.StringValue(attributes.Attributes[sqs.QueueAttributeNameQueueArn])
+
+	topicArn, err := getTopicArn(snsClient, environ)
+	if err != nil {
+		return nil, "", err
+	}
+	log.Println("bootstrap: found topic: ", topicArn)
+
+	current := aws.StringValue(attributes.Attributes[sqs.QueueAttributeNamePolicy])
+	policy, err := queuePolicy(current, queueArn, topicArn)
+	if err != nil {
+		return nil, "", err
+	}
+	if policy == "" {
+		log.Println("bootstrap: found queue policy allowing topic: ", topicArn)
+	} else {
+		_, err = sqsClient.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+			QueueUrl:   queueURL,
+			Attributes: map[string]*string{sqs.QueueAttributeNamePolicy: aws.String(policy)},
+		})
+		if err != nil {
+			return nil, "", permissionError("sqs:SetQueueAttributes", err)
+		}
+		log.Println("bootstrap: set queue policy allowing topic: ", topicArn)
+	}
+
+	subscriptionArn, err := subscribeQueue(snsClient, topicArn, queueArn)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return queueURL, subscriptionArn, nil
+}
+
+// getTopicArn returns AWS_SNS_TOPIC_ARN, or looks the topic up by
+// AWS_SNS_TOPIC_NAME.
+func getTopicArn(snsClient *sns.SNS, environ *env) (string, error) {
+	if environ.AwsSnsTopicArn != "" {
+		return environ.AwsSnsTopicArn, nil
+	}
+
+	topicArn := ""
+	err := snsClient.ListTopicsPages(&sns.ListTopicsInput{}, func(output *sns.ListTopicsOutput, lastPage bool) bool {
+		for _, topic := range output.Topics {
+			if strings.HasSuffix(aws.StringValue(topic.TopicArn), ":"+environ.AwsSnsTopicName) {
+				topicArn = aws.StringValue(topic.TopicArn)
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", permissionError("sns:ListTopics", err)
+	}
+	if topicArn == "" {
+		return "", fmt.Errorf("no topic found: %v", environ.AwsSnsTopicName)
+	}
+	return topicArn, nil
+}
+
+// queuePolicySid identifies the statement added by the bootstrap.
+const queuePolicySid = "haproxyconf-sns-topic"
+
+// queuePolicy returns current, the policy of the queue, with a statement
+// allowing the topic to send to the queue. The statements added by the
+// operator, e.g. for other accounts or EventBridge, are kept. It returns ""
+// when current already allows the topic.
+func queuePolicy(current, queueArn, topicArn string) (string, error) {
+	policy := map[string]interface{}{"Version": "2012-10-17"}
+	var statements []interface{}
+	if current != "" {
+		err := json.Unmarshal([]byte(current), &policy)
+		if err != nil {
+			return "", fmt.Errorf("error when parsing queue policy: %v", err)
+		}
+		// a single statement doesn't have to be wrapped in a list
+		switch statement := policy["Statement"].(type) {
+		case []interface{}:
+			statements = statement
+		case map[string]interface{}:
+			statements = []interface{}{statement}
+		}
+	}
+
+	var kept []interface{}
+	for _, statement := range statements {
+		statement, ok := statement.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if allowsTopic(statement, queueArn, topicArn) {
+			return "", nil
+		}
+		// a statement for a previous topic is replaced
+		if statement["Sid"] != queuePolicySid {
+			kept = append(kept, statement)
+		}
+	}
+	policy["Statement"] = append(kept, map[string]interface{}{
+		"Sid":       queuePolicySid,
+		"Effect":    "Allow",
+		"Principal": map[string]string{"Service": "sns.amazonaws.com"},
+		"Action":    "sqs:SendMessage",
+		"Resource":  queueArn,
+		"Condition": map[string]interface{}{
+			"ArnEquals": map[string]string{"aws:SourceArn": topicArn},
+		},
+	})
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return "", err
+	}
+	return string(policyJSON), nil
+}
+
+// allowsTopic reports whether a policy statement lets the topic send to the
+// queue.
+func allowsTopic(statement map[string]interface{}, queueArn, topicArn string) bool {
+	if statement["Effect"] != "Allow" || statement["Resource"] != queueArn {
+		return false
+	}
+	action := statement["Action"]
+	if action != "sqs:SendMessage" && action != "sqs:*" {
+		return false
+	}
+	condition, _ := statement["Condition"].(map[string]interface{})
+	for _, operator := range []string{"ArnEquals", "ArnLike"} {
+		values, _ := condition[operator].(map[string]interface{})
+		if values["aws:SourceArn"] == topicArn {
+			return true
+		}
+	}
+	return false
+}
+
+func subscribeQueue(snsClient *sns.SNS, topicArn, queueArn string) (string, error) {
+	subscriptionArn := ""
+	err := snsClient.ListSubscriptionsByTopicPages(&sns.ListSubscriptionsByTopicInput{
+		TopicArn: aws.String(topicArn),
+	}, func(output *sns.ListSubscriptionsByTopicOutput, lastPage bool) bool {
+		for _, subscription := range output.Subscriptions {
+			if aws.StringValue(subscription.Protocol) == "sqs" &&
+				aws.StringValue(subscription.Endpoint) == queueArn {
+				subscriptionArn = aws.StringValue(subscription.SubscriptionArn)
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", permissionError("sns:ListSubscriptionsByTopic", err)
+	}
+	if subscriptionArn != "" {
+		log.Println("bootstrap: found subscription of queue to topic: ", queueArn)
+		return subscriptionArn, nil
+	}
+
+	output, err := snsClient.Subscribe(&sns.SubscribeInput{
+		TopicArn:              aws.String(topicArn),
+		Protocol:              aws.String("sqs"),
+		Endpoint:              aws.String(queueArn),
+		ReturnSubscriptionArn: aws.Bool(true),
+	})
+	if err != nil {
+		return "", permissionError("sns:Subscribe", err)
+	}
+	log.Println("bootstrap: created subscription: ", aws.StringValue(output.SubscriptionArn))
+	return aws.StringValue(output.SubscriptionArn), nil
+}
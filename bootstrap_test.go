@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const (
+	testQueueArn = "arn:aws:sqs:us-east-1:123456789012:haproxy"
+	testTopicArn = "arn:aws:sns:us-east-1:123456789012:asg"
+)
+
+func policyStatements(t *testing.T, policy string) []map[string]interface{} {
+	var parsed struct {
+		Statement []map[string]interface{}
+	}
+	err := json.Unmarshal([]byte(policy), &parsed)
+	if err != nil {
+		t.Fatalf("invalid policy %q: %v", policy, err)
+	}
+	return parsed.Statement
+}
+
+func TestQueuePolicyWithoutPolicy(t *testing.T) {
+	policy, err := queuePolicy("", testQueueArn, testTopicArn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := policyStatements(t, policy)
+	if len(statements) != 1 || statements[0]["Sid"] != queuePolicySid {
+		t.Errorf("queuePolicy() = %v, want only the topic statement", policy)
+	}
+}
+
+func TestQueuePolicyKeepsStatements(t *testing.T) {
+	current := `{"Version":"2012-10-17","Statement":{"Sid":"events","Effect":"Allow",` +
+		`"Principal":{"Service":"events.amazonaws.com"},"Action":"sqs:SendMessage","Resource":"` + testQueueArn + `"}}`
+	policy, err := queuePolicy(current, testQueueArn, testTopicArn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := policyStatements(t, policy)
+	if len(statements) != 2 || statements[0]["Sid"] != "events" || statements[1]["Sid"] != queuePolicySid {
+		t.Errorf("queuePolicy() = %v, want the existing statement and the topic statement", policy)
+	}
+}
+
+func TestQueuePolicyReplacesPreviousTopic(t *testing.T) {
+	previous, err := queuePolicy("", testQueueArn, "arn:aws:sns:us-east-1:123456789012:old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := queuePolicy(previous, testQueueArn, testTopicArn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := policyStatements(t, policy)
+	if len(statements) != 1 {
+		t.Fatalf("queuePolicy() = %v, want a single topic statement", policy)
+	}
+	condition := statements[0]["Condition"].(map[string]interface{})["ArnEquals"].(map[string]interface{})
+	if condition["aws:SourceArn"] != testTopicArn {
+		t.Errorf("queuePolicy() allows %v, want %v", condition["aws:SourceArn"], testTopicArn)
+	}
+}
+
+func TestQueuePolicyAlreadyAllowed(t *testing.T) {
+	current, err := queuePolicy("", testQueueArn, testTopicArn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := queuePolicy(current, testQueueArn, testTopicArn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy != "" {
+		t.Errorf("queuePolicy() = %v, want no change", policy)
+	}
+}
+
+func TestQueuePolicyInvalid(t *testing.T) {
+	_, err := queuePolicy("{", testQueueArn, testTopicArn)
+	if err == nil {
+		t.Error("queuePolicy() accepted an invalid policy")
+	}
+}
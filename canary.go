@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCanaryRetryPeriod = 5 * time.Minute
+	canaryRetryInterval      = 15 * time.Second
+)
+
+// canaryCheck connects to the servers a config adds before it's installed.
+// When more than maxFraction of them are unreachable the additions are held
+// back, removals and other changes still go through, and the update is
+// retried until the servers are reachable or the retry period ends.
+type canaryCheck struct {
+	maxFraction float64
+	period      time.Duration
+	// heldSince is when additions were first held back, zero when none are
+	heldSince time.Time
+	timer     *time.Timer
+}
+
+// newCanaryCheck returns nil unless CANARY_MAX_UNREACHABLE_FRACTION is set.
+func newCanaryCheck(environ *env) (*canaryCheck, error) {
+	if environ.CanaryMaxUnreachableFraction == "" {
+		return nil, nil
+	}
+	fraction, err := strconv.ParseFloat(environ.CanaryMaxUnreachableFraction, 64)
+	if err != nil || fraction < 0 || fraction >= 1 {
+		return nil, fmt.Errorf("invalid CANARY_MAX_UNREACHABLE_FRACTION %q, expected a number in [0, 1)",
+			environ.CanaryMaxUnreachableFraction)
+	}
+	c := &canaryCheck{maxFraction: fraction, period: defaultCanaryRetryPeriod}
+	if environ.CanaryRetrySeconds > 0 {
+		c.period = time.Duration(environ.CanaryRetrySeconds) * time.Second
+	}
+	return c, nil
+}
+
+// unreachable connects to every item concurrently and returns the ones that
+// refused.
+func unreachable(items []templateItem) []templateItem {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var failed []templateItem
+	for _, item := range items {
+		wg.Add(1)
+		go func(item templateItem) {
+			defer wg.Done()
+			err := probeTCP(item.Host, item.Port, defaultProbeTimeout)
+			if err != nil {
+				log.Printf("canary connection to %v (%v:%d) failed: %v\n", item.Name, item.Host, item.Port, err)
+				mu.Lock()
+				failed = append(failed, item)
+				mu.Unlock()
+			}
+		}(item)
+	}
+	wg.Wait()
+	return failed
+}
+
+// filter returns the config to install. It's config itself, or config
+// without the servers it adds when too many of those are unreachable, in
+// which case held is set.
+func (c *canaryCheck) filter(applied, config map[string][]templateItem) (map[string][]templateItem, bool) {
+	if c == nil || len(applied) == 0 {
+		return config, false
+	}
+	before := serverKeys(applied)
+	added := make(map[string][]templateItem)
+	var addedItems []templateItem
+	for groupName, items := range config {
+		for _, item := range items {
+			if !before[groupName+"/"+serverKey(item)] {
+				added[groupName] = append(added[groupName], item)
+				addedItems = append(addedItems, item)
+			}
+		}
+	}
+	if len(addedItems) == 0 {
+		c.heldSince = time.Time{}
+		return config, false
+	}
+
+	failed := unreachable(addedItems)
+	if float64(len(failed))/float64(len(addedItems)) <= c.maxFraction {
+		c.heldSince = time.Time{}
+		return config, false
+	}
+	if c.heldSince.IsZero() {
+		c.heldSince = time.Now()
+	}
+	rejectUpdate(fmt.Errorf("%d of %d new servers are unreachable, holding them back (CANARY_MAX_UNREACHABLE_FRACTION is %v)",
+		len(failed), len(addedItems), c.maxFraction))
+
+	filtered := make(map[string][]templateItem)
+	for groupName, items := range config {
+		for _, item := range items {
+			if before[groupName+"/"+serverKey(item)] {
+				filtered[groupName] = append(filtered[groupName], item)
+			}
+		}
+	}
+	return filtered, true
+}
+
+// retry schedules run, as long as the retry period since the additions were
+// first held back hasn't passed. run has to clear timer.
+func (c *canaryCheck) retry(run func()) {
+	if c.timer != nil {
+		return
+	}
+	if time.Since(c.heldSince) > c.period {
+		log.Printf("warning: new servers unreachable for more than %v, giving up until the next update\n", c.period)
+		c.heldSince = time.Time{}
+		return
+	}
+	c.timer = time.AfterFunc(canaryRetryInterval, run)
+}
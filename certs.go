@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// certBundle is a PEM file downloaded from url to path.
+type certBundle struct {
+	url  string
+	path string
+}
+
+// certInstaller keeps the HAPROXY_CERTS bundles, a comma separated list of
+// s3://bucket/key=/local/path pairs, in place before the config is written.
+type certInstaller struct {
+	s3Client  *s3.S3
+	bundles   []certBundle
+	ownership *fileOwnership
+	// etags are the S3 ETags of the installed bundles by path, which for
+	// multipart uploads aren't the MD5 localETag computes
+	etags map[string]string
+}
+
+// newCertInstaller returns nil unless HAPROXY_CERTS is set. New bundles get
+// the configured file ownership.
+func newCertInstaller(environ *env, s3Client *s3.S3, ownership *fileOwnership) (*certInstaller, error) {
+	pairs := splitList(environ.HaproxyCerts)
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	c := &certInstaller{s3Client: s3Client, ownership: ownership, etags: make(map[string]string)}
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !isS3URL(parts[0]) || parts[1] == "" {
+			return nil, fmt.Errorf("invalid HAPROXY_CERTS entry %q, expected s3://bucket/key=/local/path", pair)
+		}
+		c.bundles = append(c.bundles, certBundle{url: parts[0], path: parts[1]})
+	}
+	return c, nil
+}
+
+// localETag returns the ETag S3 has for a single part upload of the local
+// file, its quoted MD5, or "" when there is no local file. Bundles uploaded
+// in several parts never match it, they are downloaded once after a restart
+// and compared by content instead.
+func localETag(path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("\"%x\"", md5.Sum(content))
+}
+
+// verifyPEM checks the bundle holds at least one certificate.
+func verifyPEM(content []byte) error {
+	certificates := 0
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certificates++
+		}
+	}
+	if certificates == 0 {
+		return fmt.Errorf("no PEM certificate found")
+	}
+	return nil
+}
+
+// install downloads the bundles that changed and moves them into place once
+// all of them downloaded and parsed, so a failure leaves every file as it
+// was. It reports whether any bundle was replaced.
+func (c *certInstaller) install() (bool, error) {
+	if c == nil {
+		return false, nil
+	}
+	var staged []string
+	defer func() {
+		// a no-op for the files that were renamed
+		for _, name := range staged {
+			os.Remove(name)
+		}
+	}()
+	var dests []string
+	etags := make(map[string]string)
+	for _, bundle := range c.bundles {
+		etag, ok := c.etags[bundle.path]
+		if !ok {
+			etag = localETag(bundle.path)
+		}
+		content, etag, err := fetchS3Template(c.s3Client, bundle.url, etag)
+		if err == errTemplateNotModified {
+			continue
+		}
+		if err != nil {
+			log.Printf("error when downloading certificate %v: %v\n", bundle.url, err)
+			return false, err
+		}
+		err = verifyPEM([]byte(content))
+		if err != nil {
+			return false, fmt.Errorf("certificate %v: %v", bundle.url, err)
+		}
+		if existing, err := ioutil.ReadFile(bundle.path); err == nil && string(existing) == content {
+			c.etags[bundle.path] = etag
+			continue
+		}
+		f, err := ioutil.TempFile(filepath.Dir(bundle.path), filepath.Base(bundle.path)+".tmp")
+		if err != nil {
+			return false, err
+		}
+		staged = append(staged, f.Name())
+		_, err = f.WriteString(content)
+		if err == nil {
+			err = c.applyOwnership(f, bundle.path)
+		}
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Println("error when writing certificate: ", err)
+			return false, err
+		}
+		dests = append(dests, bundle.path)
+		etags[bundle.path] = etag
+	}
+
+	for i, dest := range dests {
+		err := os.Rename(staged[i], dest)
+		if err != nil {
+			log.Println("error when replacing certificate: ", err)
+			return false, err
+		}
+		c.etags[dest] = etags[dest]
+		log.Println("installed certificate: ", dest)
+	}
+	return len(dests) > 0, nil
+}
+
+// applyOwnership gives a staged bundle the mode and owner of the bundle it
+// replaces, so haproxy running as another user can still read it. A new
+// bundle gets the configured file ownership, and is only readable by owner
+// and group unless HAPROXY_FILE_MODE says otherwise, it holds a private key.
+// Failing to change the owner is only logged, it needs root.
+func (c *certInstaller) applyOwnership(f *os.File, dest string) error {
+	mode := os.FileMode(0640)
+	uid, gid := -1, -1
+	if c.ownership != nil {
+		if c.ownership.mode != nil {
+			mode = *c.ownership.mode
+		}
+		uid, gid = c.ownership.uid, c.ownership.gid
+	}
+	if info, err := os.Stat(dest); err == nil {
+		mode = info.Mode().Perm()
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(stat.Uid), int(stat.Gid)
+		}
+	}
+	err := f.Chmod(mode)
+	if err != nil {
+		return err
+	}
+
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	err = f.Chown(uid, gid)
+	if err != nil {
+		log.Printf("warning: can't change owner of %v to %d:%d, running as uid %d (not root?): %v\n",
+			dest, uid, gid, os.Geteuid(), err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCertApplyOwnership(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	existing := filepath.Join(dir, "existing.pem")
+	ioutil.WriteFile(existing, []byte("old"), 0644)
+	os.Chmod(existing, 0644)
+	configured := os.FileMode(0600)
+
+	tests := []struct {
+		name      string
+		dest      string
+		ownership *fileOwnership
+		want      os.FileMode
+	}{
+		{"keeps the mode of the replaced bundle", existing, &fileOwnership{uid: -1, gid: -1}, 0644},
+		{"existing mode wins over the configured one", existing, &fileOwnership{mode: &configured, uid: -1, gid: -1}, 0644},
+		{"new bundle", filepath.Join(dir, "new.pem"), &fileOwnership{uid: -1, gid: -1}, 0640},
+		{"new bundle with a configured mode", filepath.Join(dir, "new.pem"), &fileOwnership{mode: &configured, uid: -1, gid: -1}, 0600},
+	}
+	for _, tt := range tests {
+		// staged like install does, TempFile creates it with 0600
+		f, err := ioutil.TempFile(dir, "staged")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &certInstaller{ownership: tt.ownership}
+		err = c.applyOwnership(f, tt.dest)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%v: applyOwnership() error = %v", tt.name, err)
+		}
+		info, _ := os.Stat(f.Name())
+		if info.Mode().Perm() != tt.want {
+			t.Errorf("%v: mode = %v, want %v", tt.name, info.Mode().Perm(), tt.want)
+		}
+		os.Remove(f.Name())
+	}
+}
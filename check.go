@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultCheckCommand = "haproxy -c -f %s"
+	defaultCheckTimeout = 10 * time.Second
+)
+
+// configChecker validates a rendered config before it replaces the current
+// one. The command runs through sh -c like HAPROXY_RELOAD_COMMAND, with the
+// path of the new config as $1, which %s stands for.
+type configChecker struct {
+	command string
+	timeout time.Duration
+}
+
+// newConfigChecker returns nil when HAPROXY_CHECK_DISABLED is set. The
+// command is HAPROXY_CHECK_COMMAND, or its alias CONFIG_CHECK_COMMAND.
+func newConfigChecker(environ *env) *configChecker {
+	if environ.HaproxyCheckDisabled {
+		return nil
+	}
+	c := &configChecker{
+		command: environ.HaproxyCheckCommand,
+		timeout: defaultCheckTimeout,
+	}
+	// CONFIG_CHECK_COMMAND reads better when it isn't haproxy
+	if c.command == "" {
+		c.command = environ.ConfigCheckCommand
+	}
+	if c.command == "" {
+		c.command = defaultCheckCommand
+	}
+	if environ.HaproxyCheckTimeoutSeconds > 0 {
+		c.timeout = time.Duration(environ.HaproxyCheckTimeoutSeconds) * time.Second
+	}
+	return c
+}
+
+// check runs the command against the config file and returns its stderr
+// as part of the error when it fails.
+func (c *configChecker) check(path string) error {
+	if c == nil {
+		return nil
+	}
+	if strings.TrimSpace(c.command) == "" {
+		return fmt.Errorf("empty HAPROXY_CHECK_COMMAND")
+	}
+
+	args := c.args(path)
+	cmd := exec.Command(args[0], args[1:]...)
+	// in its own process group, so what the shell started is killed too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Start()
+	if err != nil {
+		return fmt.Errorf("config check failed: %v", err)
+	}
+	timedOut := int32(0)
+	timer := time.AfterFunc(c.timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err = cmd.Wait()
+	timer.Stop()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("config check timed out after %v", c.timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("config check failed: %v: %v", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// args returns the command line of the check, quoting the path so it may
+// contain spaces.
+func (c *configChecker) args(path string) []string {
+	return []string{"sh", "-c", strings.Replace(c.command, "%s", `"$1"`, -1), "sh", path}
+}
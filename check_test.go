@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigCheckerPathWithSpaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "haproxy new.cfg")
+	err = ioutil.WriteFile(path, []byte("global\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		command string
+		wantErr bool
+	}{
+		{"test -f %s", false},
+		{`test -f "$1"`, false},
+		{"grep -q global %s", false},
+		{"grep -q defaults %s", true},
+		{"test -f " + path, true},
+		{" ", true},
+	}
+	for _, tt := range tests {
+		c := &configChecker{command: tt.command, timeout: 5 * time.Second}
+		err := c.check(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("check() with %q error = %v, want error %v", tt.command, err, tt.wantErr)
+		}
+	}
+}
+
+func TestConfigCheckerTimeout(t *testing.T) {
+	c := &configChecker{command: "sleep 5", timeout: 100 * time.Millisecond}
+	if err := c.check("/dev/null"); err == nil {
+		t.Error("check() didn't time out")
+	}
+}
+
+func TestConfigCheckerDisabled(t *testing.T) {
+	c := newConfigChecker(&env{HaproxyCheckDisabled: true})
+	if err := c.check("/nonexistent"); err != nil {
+		t.Errorf("disabled check() = %v", err)
+	}
+}
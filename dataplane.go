@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDataPlaneRetries = 3
+	dataPlaneTimeout        = 10 * time.Second
+	dataPlaneConfigPath     = "/services/haproxy/configuration"
+	dataPlaneTxPath         = "/services/haproxy/transactions"
+)
+
+// errVersionConflict is returned when the configuration changed between
+// starting a transaction and committing it.
+var errVersionConflict = errors.New("data plane configuration version changed")
+
+// dataPlaneClient reconciles backend servers through the HAProxy Data Plane
+// API instead of rendering and reloading the config file.
+type dataPlaneClient struct {
+	baseURL  string
+	user     string
+	password string
+	token    string
+	retries  int
+	dryRun   bool
+	client   *http.Client
+}
+
+// dataPlaneServer is the subset of the API's server model we manage.
+type dataPlaneServer struct {
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	Port        int    `json:"port"`
+	Weight      int    `json:"weight"`
+	Check       string `json:"check,omitempty"`
+	Backup      string `json:"backup,omitempty"`
+	Maintenance string `json:"maintenance,omitempty"`
+}
+
+// dataPlaneOp is a planned change to the servers of a backend.
+type dataPlaneOp struct {
+	method  string
+	backend string
+	server  dataPlaneServer
+}
+
+func (op dataPlaneOp) String() string {
+	return fmt.Sprintf("%v %v/%v %v:%d weight %d", op.method, op.backend, op.server.Name,
+		op.server.Address, op.server.Port, op.server.Weight)
+}
+
+// newDataPlaneClient returns nil unless DATAPLANE_URL is set.
+func newDataPlaneClient(environ *env) *dataPlaneClient {
+	if environ.DataplaneURL == "" {
+		return nil
+	}
+	c := &dataPlaneClient{
+		baseURL:  strings.TrimSuffix(environ.DataplaneURL, "/"),
+		user:     environ.DataplaneUser,
+		password: environ.DataplanePassword,
+		token:    environ.DataplaneToken,
+		retries:  defaultDataPlaneRetries,
+		dryRun:   environ.DataplaneDryRun,
+		client:   &http.Client{Timeout: dataPlaneTimeout},
+	}
+	if environ.DataplaneRetries > 0 {
+		c.retries = environ.DataplaneRetries
+	}
+	return c
+}
+
+func newDataPlaneServer(item templateItem) dataPlaneServer {
+	server := dataPlaneServer{
+		Name:    item.Name,
+		Address: item.Host,
+		Port:    item.Port,
+		Weight:  item.Weight,
+		Check:   "enabled",
+	}
+	if item.Backup {
+		server.Backup = "enabled"
+	}
+	if item.Disabled {
+		server.Maintenance = "enabled"
+	}
+	return server
+}
+
+// do sends a request and decodes the JSON response into out, when it's set.
+func (c *dataPlaneClient) do(method, path string, query url.Values, body, out interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	reqURL := c.baseURL + path
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, reqURL, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return errVersionConflict
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%v %v: %v: %v", method, path, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+func (c *dataPlaneClient) version() (int, error) {
+	var version int
+	err := c.do(http.MethodGet, dataPlaneConfigPath+"/version", nil, nil, &version)
+	return version, err
+}
+
+func (c *dataPlaneClient) servers(backend, txID string) ([]dataPlaneServer, error) {
+	query := url.Values{"backend": {backend}}
+	if txID != "" {
+		query.Set("transaction_id", txID)
+	}
+	var out struct {
+		Data []dataPlaneServer `json:"data"`
+	}
+	err := c.do(http.MethodGet, dataPlaneConfigPath+"/servers", query, nil, &out)
+	return out.Data, err
+}
+
+// plan works out the operations that turn the current servers of every
+// backend into the discovered ones, matching servers by name.
+func (c *dataPlaneClient) plan(data templateData, txID string) ([]dataPlaneOp, error) {
+	var ops []dataPlaneOp
+	for _, backend := range data.Backends {
+		current, err := c.servers(backend.Name, txID)
+		if err != nil {
+			return nil, err
+		}
+		existing := make(map[string]dataPlaneServer, len(current))
+		for _, server := range current {
+			existing[server.Name] = server
+		}
+		for _, item := range backend.Servers {
+			server := newDataPlaneServer(item)
+			old, ok := existing[server.Name]
+			delete(existing, server.Name)
+			switch {
+			case !ok:
+				ops = append(ops, dataPlaneOp{http.MethodPost, backend.Name, server})
+			case old != server:
+				ops = append(ops, dataPlaneOp{http.MethodPut, backend.Name, server})
+			}
+		}
+		for _, server := range current {
+			if _, ok := existing[server.Name]; ok {
+				ops = append(ops, dataPlaneOp{http.MethodDelete, backend.Name, server})
+			}
+		}
+	}
+	return ops, nil
+}
+
+// apply reconciles the servers inside one transaction and retries the whole
+// transaction when the configuration version changed underneath it. It
+// reports whether a transaction with changes was committed.
+func (c *dataPlaneClient) apply(data templateData) (bool, error) {
+	if c.dryRun {
+		ops, err := c.plan(data, "")
+		if err != nil {
+			return false, err
+		}
+		for _, op := range ops {
+			log.Println("dry run, would apply: ", op)
+		}
+		log.Printf("dry run, %d data plane operation(s) planned\n", len(ops))
+		return false, nil
+	}
+
+	var committed bool
+	var err error
+	for attempt := 1; attempt <= c.retries; attempt++ {
+		committed, err = c.applyOnce(data)
+		if err != errVersionConflict {
+			return committed, err
+		}
+		log.Printf("data plane version conflict, retrying transaction (attempt %d of %d)\n", attempt, c.retries)
+	}
+	return false, err
+}
+
+func (c *dataPlaneClient) applyOnce(data templateData) (bool, error) {
+	version, err := c.version()
+	if err != nil {
+		log.Println("error when getting data plane configuration version: ", err)
+		return false, err
+	}
+	var tx struct {
+		ID string `json:"id"`
+	}
+	err = c.do(http.MethodPost, dataPlaneTxPath, url.Values{"version": {fmt.Sprint(version)}}, nil, &tx)
+	if err != nil {
+		log.Println("error when starting data plane transaction: ", err)
+		return false, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			c.do(http.MethodDelete, dataPlaneTxPath+"/"+tx.ID, nil, nil, nil)
+		}
+	}()
+
+	ops, err := c.plan(data, tx.ID)
+	if err != nil {
+		return false, err
+	}
+	if len(ops) == 0 {
+		log.Println("data plane servers up to date")
+		return false, nil
+	}
+	for _, op := range ops {
+		query := url.Values{"backend": {op.backend}, "transaction_id": {tx.ID}}
+		path := dataPlaneConfigPath + "/servers"
+		var body interface{} = op.server
+		if op.method != http.MethodPost {
+			path += "/" + url.PathEscape(op.server.Name)
+		}
+		if op.method == http.MethodDelete {
+			body = nil
+		}
+		err = c.do(op.method, path, query, body, nil)
+		if err != nil {
+			log.Printf("error when applying %v: %v\n", op, err)
+			return false, err
+		}
+	}
+
+	err = c.do(http.MethodPut, dataPlaneTxPath+"/"+tx.ID, nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	committed = true
+	log.Printf("committed %d data plane operation(s)\n", len(ops))
+	return true, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDedupSize = 1000
+	defaultDedupTTL  = 10 * time.Minute
+)
+
+// messageDeduper remembers recently processed SNS message IDs. Entries
+// expire after ttl and at most size of them are kept, oldest evicted first.
+type messageDeduper struct {
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	seen  map[string]time.Time
+	order []string
+}
+
+func newMessageDeduper(environ *env) *messageDeduper {
+	d := &messageDeduper{
+		size: defaultDedupSize,
+		ttl:  defaultDedupTTL,
+		seen: make(map[string]time.Time),
+	}
+	if environ.AwsSqsDedupSize > 0 {
+		d.size = environ.AwsSqsDedupSize
+	}
+	if environ.AwsSqsDedupTTL > 0 {
+		d.ttl = time.Duration(environ.AwsSqsDedupTTL) * time.Second
+	}
+	return d
+}
+
+func (d *messageDeduper) expire(now time.Time) {
+	for len(d.order) > 0 {
+		oldest := d.order[0]
+		if len(d.order) <= d.size && now.Sub(d.seen[oldest]) < d.ttl {
+			return
+		}
+		delete(d.seen, oldest)
+		d.order = d.order[1:]
+	}
+}
+
+// isDuplicate reports whether the message ID was processed within the ttl.
+func (d *messageDeduper) isDuplicate(messageID string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(now)
+	processedAt, ok := d.seen[messageID]
+	if !ok {
+		return false
+	}
+	log.Printf("suppressing duplicate msg %v, processed %v ago\n",
+		messageID, now.Sub(processedAt).Round(time.Second))
+	return true
+}
+
+func (d *messageDeduper) add(messageID string, now time.Time) {
+	if messageID == "" {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.seen[messageID]; !ok {
+		d.order = append(d.order, messageID)
+	}
+	d.seen[messageID] = now
+	d.expire(now)
+}
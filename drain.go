@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDrainGrace = 30 * time.Second
+	drainPollInterval = time.Second
+)
+
+func (e *env) drainGrace() time.Duration {
+	if e.HaproxyDrainGraceSeconds > 0 {
+		return time.Duration(e.HaproxyDrainGraceSeconds) * time.Second
+	}
+	return defaultDrainGrace
+}
+
+// serverSessions returns the current sessions of every server from
+// "show stat", keyed by backend/server.
+func (s *runtimeSocket) serverSessions() (map[string]int, error) {
+	out, err := s.command("show stat")
+	if err != nil {
+		return nil, err
+	}
+	records, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(out, "# "))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("empty stats")
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	scur, ok := columns["scur"]
+	if !ok {
+		return nil, fmt.Errorf("no scur column in stats")
+	}
+	sessions := make(map[string]int)
+	for _, record := range records[1:] {
+		if len(record) <= scur || record[1] == "FRONTEND" || record[1] == "BACKEND" {
+			continue
+		}
+		sessions[record[0]+"/"+record[1]], _ = strconv.Atoi(record[scur])
+	}
+	return sessions, nil
+}
+
+// waitForSessions polls until every server has at most maxSessions sessions
+// or wait expires. It reports whether the servers got there.
+func (s *runtimeSocket) waitForSessions(servers []string, maxSessions int, wait time.Duration) bool {
+	deadline := time.Now().Add(wait)
+	for {
+		sessions, err := s.serverSessions()
+		if err != nil {
+			log.Println("error when reading server sessions: ", err)
+		} else if busy := busyServers(sessions, servers, maxSessions); len(busy) == 0 {
+			return true
+		} else if time.Now().After(deadline) {
+			log.Printf("%v still above %d sessions after %v, going ahead\n", strings.Join(busy, ", "), maxSessions, wait)
+			return false
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+func busyServers(sessions map[string]int, servers []string, maxSessions int) []string {
+	var busy []string
+	for _, server := range servers {
+		if sessions[server] > maxSessions {
+			busy = append(busy, server)
+		}
+	}
+	return busy
+}
+
+// drainInstance puts the servers of a terminating instance into drain and
+// waits for their sessions to finish, up to HAPROXY_DRAIN_GRACE_SECONDS. The
+// servers are named from the last applied config by the same logic the
+// template gets its names from.
+func (u *configUpdater) drainInstance(instanceID string) {
+	socket := u.writer.runtime
+	u.mu.Lock()
+	data := newTemplateData(u.opts, u.groupNames, u.lastConfig)
+	u.mu.Unlock()
+
+	var servers []string
+	for _, backend := range data.Backends {
+		for _, server := range backend.Servers {
+			if server.InstanceID != instanceID {
+				continue
+			}
+			target := backend.Name + "/" + server.Name
+			_, err := socket.command("set server " + target + " state drain")
+			if err != nil {
+				log.Println("error when draining server: ", err)
+				continue
+			}
+			servers = append(servers, target)
+		}
+	}
+	if len(servers) == 0 {
+		return
+	}
+	log.Printf("draining %v for up to %v\n", strings.Join(servers, ", "), u.environ.drainGrace())
+	if socket.waitForSessions(servers, 0, u.environ.drainGrace()) {
+		log.Println("drained servers of terminating instance: ", instanceID)
+	}
+}
+
+// waitForRemovedServers drains the servers haproxy runs that the new config
+// removes and holds the reload until they are down to
+// HAPROXY_DRAIN_MAX_SESSIONS sessions, for up to HAPROXY_DRAIN_WAIT_SECONDS.
+// Servers are kept when their name or their address and port match, like
+// runtimeCommands matches them, since server-template slots are named after
+// the template rather than the instance. Slots in maintenance are left alone.
+func waitForRemovedServers(socket *runtimeSocket, data templateData, environ *env) {
+	var removed []string
+	for _, backend := range data.Backends {
+		slots, err := socket.serverSlots(backend.Name)
+		if err != nil {
+			log.Printf("error when reading servers of %v, not waiting for its removed servers: %v\n", backend.Name, err)
+			continue
+		}
+		kept := make(map[string]bool)
+		for _, server := range backend.Servers {
+			kept[server.Name] = true
+			kept[net.JoinHostPort(server.Host, strconv.Itoa(server.Port))] = true
+			if server.PrivateIP != "" {
+				kept[net.JoinHostPort(server.PrivateIP, strconv.Itoa(server.Port))] = true
+			}
+		}
+		for _, slot := range slots {
+			if slot.maint || kept[slot.name] || kept[net.JoinHostPort(slot.addr, strconv.Itoa(slot.port))] {
+				continue
+			}
+			server := backend.Name + "/" + slot.name
+			_, err := socket.command("set server " + server + " state drain")
+			if err != nil {
+				log.Println("error when draining server: ", err)
+			}
+			removed = append(removed, server)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	wait := time.Duration(environ.HaproxyDrainWaitSeconds) * time.Second
+	log.Printf("waiting up to %v for sessions on %v to finish before reloading\n", wait, strings.Join(removed, ", "))
+	socket.waitForSessions(removed, environ.HaproxyDrainMaxSessions, wait)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+)
+
+const (
+	detailTypeStateChange = "EC2 Instance State-change Notification"
+
+	// eventStateChange prefixes the event of state changes that are neither
+	// mapped to a launch nor a termination, which leaves them unhandled
+	eventStateChange = "ec2:STATE_CHANGE:"
+)
+
+// eventBridgeEvent is an EC2 event delivered by EventBridge, either straight
+// to the queue or wrapped in an SNS notification.
+type eventBridgeEvent struct {
+	DetailType string `json:"detail-type"`
+	Source     string `json:"source"`
+	Account    string `json:"account"`
+	Region     string `json:"region"`
+	Detail     struct {
+		InstanceID string `json:"instance-id"`
+		State      string `json:"state"`
+	} `json:"detail"`
+}
+
+func parseEventBridgeEvent(message string) (*eventBridgeEvent, bool) {
+	event := &eventBridgeEvent{}
+	err := json.Unmarshal([]byte(message), event)
+	if err != nil || event.DetailType == "" || event.Detail.InstanceID == "" {
+		return nil, false
+	}
+	return event, true
+}
+
+// eventBridgeAccountID returns AWS_EVENTBRIDGE_ACCOUNT_ID, the account EC2
+// events are accepted from, and defaults to the queue owner.
+func (e *env) eventBridgeAccountID() string {
+	if e.AwsEventBridgeAccountID != "" {
+		return e.AwsEventBridgeAccountID
+	}
+	return e.AwsSqsQueueOwnerAccountID
+}
+
+// isTrustedEventBridgeEvent reports whether a raw body is an EC2 event of the
+// configured account in one of the discovery regions. Without an account
+// configured none is.
+func (e *env) isTrustedEventBridgeEvent(body string) bool {
+	event, ok := parseEventBridgeEvent(body)
+	if !ok || event.Source != "aws.ec2" || e.eventBridgeAccountID() == "" || event.Account != e.eventBridgeAccountID() {
+		return false
+	}
+	for _, region := range e.regions() {
+		if event.Region == region {
+			return true
+		}
+	}
+	return false
+}
+
+// notification maps an instance state change onto the autoscaling event with
+// the same effect on the backends: running instances are added, stopped and
+// terminated ones removed.
+func (e *eventBridgeEvent) notification() (*autoScalingNotification, bool) {
+	if e.DetailType != detailTypeStateChange {
+		return nil, false
+	}
+	notification := &autoScalingNotification{EC2InstanceId: e.Detail.InstanceID}
+	switch e.Detail.State {
+	case "running":
+		notification.Event = eventInstanceLaunch
+	case "stopped", "terminated":
+		notification.Event = eventInstanceTerminate
+	default:
+		notification.Event = eventStateChange + e.Detail.State
+	}
+	return notification, true
+}
+
+// parseNotification parses the inner message as an autoscaling notification,
+// a terminating lifecycle hook or an EventBridge instance state change.
+func parseNotification(message string) (*autoScalingNotification, bool) {
+	notification, ok := parseAutoScalingNotification(message)
+	if ok {
+		return notification, true
+	}
+	lifecycle, ok := parseLifecycleNotification(message)
+	if ok {
+		return lifecycle.notification(), true
+	}
+	event, ok := parseEventBridgeEvent(message)
+	if !ok {
+		return nil, false
+	}
+	return event.notification()
+}
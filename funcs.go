@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+const defaultTemplateEnvPrefix = "HAPROXY_TPL_"
+
+// templateFuncs returns the helpers available to templates. Arguments are
+// ordered so the value being transformed comes last and can be piped in.
+func templateFuncs(environ *env) template.FuncMap {
+	envPrefix := environ.HaproxyTemplateEnvPrefix
+	if envPrefix == "" {
+		envPrefix = defaultTemplateEnvPrefix
+	}
+
+	return template.FuncMap{
+		"lower": strings.ToLower,
+		"upper": strings.ToUpper,
+		"replace": func(old, new, s string) string {
+			return strings.Replace(s, old, new, -1)
+		},
+		"trimPrefix": func(prefix, s string) string {
+			return strings.TrimPrefix(s, prefix)
+		},
+		"trimSuffix": func(suffix, s string) string {
+			return strings.TrimSuffix(s, suffix)
+		},
+		"hasPrefix": func(prefix, s string) bool {
+			return strings.HasPrefix(s, prefix)
+		},
+		"join":    joinValues,
+		"default": defaultValue,
+		// env only exposes variables starting with the allowed prefix, so a
+		// template can't leak credentials into the config
+		"env": func(name string) string {
+			if !strings.HasPrefix(name, envPrefix) {
+				return ""
+			}
+			return os.Getenv(name)
+		},
+	}
+}
+
+// joinValues joins the elements of any slice, formatted like fmt.Sprint.
+func joinValues(sep string, list interface{}) (string, error) {
+	value := reflect.ValueOf(list)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: expected a list, got %T", list)
+	}
+	elements := make([]string, value.Len())
+	for i := range elements {
+		elements[i] = fmt.Sprint(value.Index(i).Interface())
+	}
+	return strings.Join(elements, sep), nil
+}
+
+// defaultValue returns value, or fallback when value is empty.
+func defaultValue(fallback, value interface{}) interface{} {
+	if value == nil {
+		return fallback
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.String, reflect.Array:
+		if v.Len() == 0 {
+			return fallback
+		}
+	case reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64, reflect.Ptr, reflect.Interface:
+		if v.IsZero() {
+			return fallback
+		}
+	}
+	return value
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	os.Setenv("HAPROXY_TPL_STATS_USER", "admin")
+	os.Setenv("TEST_FUNCS_SECRET", "leaked")
+	defer os.Unsetenv("HAPROXY_TPL_STATS_USER")
+	defer os.Unsetenv("TEST_FUNCS_SECRET")
+
+	data := testTemplateData()
+	tests := []struct {
+		text string
+		want string
+	}{
+		{`{{ "Web-1" | lower }}`, "web-1"},
+		{`{{ "web-1" | upper }}`, "WEB-1"},
+		{`{{ "ip-10-0-0-1.ec2.internal" | replace "." "-" }}`, "ip-10-0-0-1-ec2-internal"},
+		{`{{ "ip-10-0-0-1.ec2.internal" | trimSuffix ".ec2.internal" }}`, "ip-10-0-0-1"},
+		{`{{ "web-1" | trimPrefix "web-" }}`, "1"},
+		{`{{ if "web-1" | hasPrefix "web" }}yes{{ end }}`, "yes"},
+		{`{{ .Servers | join " " }}`, "10.0.0.1:80 10.0.0.2:80 10.0.0.3:80"},
+		{`{{ .Group | default "none" }} {{ "" | default "none" }}`, "web none"},
+		{`{{ 0 | default 1 }} {{ false | default true }}`, "1 true"},
+		{`{{ env "HAPROXY_TPL_STATS_USER" }}`, "admin"},
+		{`[{{ env "TEST_FUNCS_SECRET" }}]`, "[]"},
+	}
+	for _, tt := range tests {
+		tmpl, err := template.New("test").Funcs(templateFuncs(&env{})).Parse(tt.text)
+		if err != nil {
+			t.Errorf("parsing %q failed: %v", tt.text, err)
+			continue
+		}
+		var out bytes.Buffer
+		err = tmpl.Execute(&out, data)
+		if err != nil {
+			t.Errorf("rendering %q failed: %v", tt.text, err)
+			continue
+		}
+		if out.String() != tt.want {
+			t.Errorf("rendered %q as %q, want %q", tt.text, out.String(), tt.want)
+		}
+	}
+}
+
+func TestTemplateFuncsEnvPrefix(t *testing.T) {
+	os.Setenv("CUSTOM_NAME", "web")
+	defer os.Unsetenv("CUSTOM_NAME")
+
+	funcs := templateFuncs(&env{HaproxyTemplateEnvPrefix: "CUSTOM_"})
+	tmpl := template.Must(template.New("test").Funcs(funcs).Parse(`{{ env "CUSTOM_NAME" }}`))
+	var out bytes.Buffer
+	err := tmpl.Execute(&out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "web" {
+		t.Errorf("rendered %q, want %q", out.String(), "web")
+	}
+}
+
+func TestJoinRejectsScalars(t *testing.T) {
+	tmpl := template.Must(template.New("test").Funcs(templateFuncs(&env{})).Parse(`{{ .Count | join "," }}`))
+	err := tmpl.Execute(&bytes.Buffer{}, testTemplateData())
+	if err == nil || !strings.Contains(err.Error(), "expected a list") {
+		t.Errorf("join of a number = %v, want an error", err)
+	}
+}
+
+func TestUnknownTemplateFuncFails(t *testing.T) {
+	f, err := ioutil.TempFile("", "haproxy.cfg.template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{{ .Group | titlecase }}`)
+	f.Close()
+
+	_, err = loadTemplates([]renderPair{{Template: f.Name(), Dest: "/dev/null"}}, templateFuncs(&env{}), false, nil)
+	if err == nil {
+		t.Error("loading a template with an unknown function succeeded")
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+)
+
+// generate runs a single discovery and renders the templates to stdout, for
+// trying out a template or the IAM permissions without touching the queue,
+// the config files or haproxy.
+func generate(regionClients []*regionClient, opts *discoveryOptions, groupNames []string, environ *env) error {
+	config, err := getEC2ConfigWaitingForAddresses(regionClients, opts, groupNames)
+	if err != nil {
+		return err
+	}
+	data := environ.templateRoot(newTemplateData(opts, groupNames, config))
+	for _, t := range haProxyTemplates {
+		err = t.Execute(os.Stdout, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const (
+	defaultHistoryKeep = 20
+	// fixed width nanoseconds, so copies of the same second don't collide
+	// and the names still sort by time
+	historyTimeFormat = "2006-01-02T15:04:05.000000000Z"
+)
+
+// historyPattern matches the history copies of the file named base, with or
+// without the nanoseconds older versions left out.
+func historyPattern(base string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(base) + `\.\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d{9})?Z$`)
+}
+
+// historyKeep returns how many configs are kept in HAPROXY_HISTORY_DIR.
+func (e *env) historyKeep() int {
+	if e.HaproxyHistoryKeep > 0 {
+		return e.HaproxyHistoryKeep
+	}
+	return defaultHistoryKeep
+}
+
+// recordHistory copies the config installed at path into the history dir
+// under a timestamped name and prunes the oldest copies. Only files matching
+// that naming are ever removed. It does nothing unless HAPROXY_HISTORY_DIR is
+// set. Errors are logged, history is best-effort.
+func recordHistory(environ *env, path string, now time.Time) {
+	if environ.HaproxyHistoryDir == "" {
+		return
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Println("error when reading config for history: ", err)
+		return
+	}
+
+	base := filepath.Base(path)
+	name := filepath.Join(environ.HaproxyHistoryDir, base+"."+now.UTC().Format(historyTimeFormat))
+	err = ioutil.WriteFile(name, content, configFileMode(path))
+	if err != nil {
+		log.Println("error when writing config history: ", err)
+		return
+	}
+
+	pattern := historyPattern(base)
+	files, err := ioutil.ReadDir(environ.HaproxyHistoryDir)
+	if err != nil {
+		log.Println("error when listing config history: ", err)
+		return
+	}
+	var copies []string
+	for _, file := range files {
+		if file.Mode().IsRegular() && pattern.MatchString(file.Name()) {
+			copies = append(copies, file.Name())
+		}
+	}
+	// the timestamps sort lexically, oldest first
+	sort.Strings(copies)
+	for len(copies) > environ.historyKeep() {
+		err = os.Remove(filepath.Join(environ.HaproxyHistoryDir, copies[0]))
+		if err != nil {
+			log.Println("error when pruning config history: ", err)
+		}
+		copies = copies[1:]
+	}
+}
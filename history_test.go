@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	historyDir := filepath.Join(dir, "history")
+	os.Mkdir(historyDir, 0755)
+	// a render pair destination, HAPROXY_FILE_DEST isn't set
+	configPath := filepath.Join(dir, "lb.cfg")
+	ioutil.WriteFile(configPath, []byte("global\n"), 0644)
+	ioutil.WriteFile(filepath.Join(historyDir, "lb.cfg.2019-12-31T23:59:59Z"), []byte("old\n"), 0644)
+	ioutil.WriteFile(filepath.Join(historyDir, "notes.txt"), []byte("keep\n"), 0644)
+
+	environ := &env{HaproxyHistoryDir: historyDir, HaproxyHistoryKeep: 3}
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		// installs within the same second
+		recordHistory(environ, configPath, now.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	files, _ := ioutil.ReadDir(historyDir)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	want := []string{
+		"lb.cfg.2020-01-02T03:04:05.000000000Z",
+		"lb.cfg.2020-01-02T03:04:05.001000000Z",
+		"lb.cfg.2020-01-02T03:04:05.002000000Z",
+		"notes.txt",
+	}
+	if len(names) != len(want) {
+		t.Fatalf("history dir = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("history dir = %v, want %v", names, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const defaultHookTimeout = 30 * time.Second
+
+// hooks are shell commands run around an update, with the same argument and
+// environment as the reload command. HOOK_PRE_WRITE runs once the config is
+// rendered and checked, before it replaces the current one, and aborts the
+// update when it fails. HOOK_POST_RELOAD runs after a successful reload.
+type hooks struct {
+	preWrite   string
+	postReload string
+	timeout    time.Duration
+}
+
+func newHooks(environ *env) *hooks {
+	h := &hooks{
+		preWrite:   environ.HookPreWrite,
+		postReload: environ.HookPostReload,
+		timeout:    defaultHookTimeout,
+	}
+	if environ.HookTimeoutSeconds > 0 {
+		h.timeout = time.Duration(environ.HookTimeoutSeconds) * time.Second
+	}
+	return h
+}
+
+func (h *hooks) run(kind, command string, rc reloadContext) error {
+	if command == "" {
+		return nil
+	}
+	return runCommand(kind, command, []string{"sh", "-c", command, "sh", rc.configPath}, h.timeout, rc)
+}
+
+func (h *hooks) beforeWrite(rc reloadContext) error {
+	err := h.run("pre-write hook", h.preWrite, rc)
+	if err != nil {
+		log.Println("pre-write hook failed, keeping the current config: ", err)
+	}
+	return err
+}
+
+// afterReload only logs a failure, the reload already happened.
+func (h *hooks) afterReload(rc reloadContext) {
+	err := h.run("post-reload hook", h.postReload, rc)
+	if err != nil {
+		log.Println("error when running post-reload hook: ", err)
+	}
+}
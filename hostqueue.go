@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	defaultQueuePrefix = "haproxy-config-"
+	maxQueueNameLength = 80
+)
+
+// hostQueueName returns the name of the queue owned by this host, the
+// SQS_QUEUE_PREFIX followed by the instance ID, or by the hostname when the
+// instance metadata isn't available.
+func (e *env) hostQueueName(metadata *ec2metadata.EC2Metadata) (string, error) {
+	prefix := e.SqsQueuePrefix
+	if prefix == "" {
+		prefix = defaultQueuePrefix
+	}
+
+	id, err := metadata.GetMetadata("instance-id")
+	if err != nil {
+		log.Println("no instance metadata, naming queue after hostname: ", err)
+		id, err = os.Hostname()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// queue names only allow alphanumerics, hyphens and underscores
+	name := strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, prefix+id)
+	if len(name) > maxQueueNameLength {
+		name = name[:maxQueueNameLength]
+	}
+	return name, nil
+}
+
+// deleteHostQueue unsubscribes the queue of this host from the topic and
+// deletes it, so a host that's gone doesn't leave messages piling up.
+func deleteHostQueue(sqsClient *sqs.SQS, snsClient *sns.SNS, queueURL *string, subscriptionArn string) {
+	_, err := snsClient.Unsubscribe(&sns.UnsubscribeInput{
+		SubscriptionArn: aws.String(subscriptionArn),
+	})
+	if err != nil {
+		log.Println("error when unsubscribing queue: ", err)
+	} else {
+		log.Println("deleted subscription: ", subscriptionArn)
+	}
+
+	_, err = sqsClient.DeleteQueue(&sqs.DeleteQueueInput{
+		QueueUrl: queueURL,
+	})
+	if err != nil {
+		log.Println("error when deleting queue: ", err)
+		return
+	}
+	log.Println("deleted queue: ", aws.StringValue(queueURL))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	eventInstanceLaunch    = "autoscaling:EC2_INSTANCE_LAUNCH"
+	eventInstanceTerminate = "autoscaling:EC2_INSTANCE_TERMINATE"
+)
+
+// autoScalingNotification is the inner Message of an autoscaling SNS
+// notification.
+type autoScalingNotification struct {
+	Event                string
+	AutoScalingGroupName string
+	EC2InstanceId        string
+}
+
+func parseAutoScalingNotification(message string) (*autoScalingNotification, bool) {
+	notification := &autoScalingNotification{}
+	err := json.Unmarshal([]byte(message), notification)
+	if err != nil || notification.Event == "" {
+		return nil, false
+	}
+	return notification, true
+}
+
+// handledEvents returns the autoscaling events that trigger a regeneration.
+func (e *env) handledEvents() []string {
+	events := splitList(e.AwsAutoScalingEvents)
+	if len(events) == 0 {
+		events = []string{eventInstanceLaunch, eventInstanceTerminate}
+	}
+	return events
+}
+
+// isEventHandled reports whether a message should regenerate the config.
+// Messages that aren't autoscaling notifications or instance state changes
+// are always handled.
+func (e *env) isEventHandled(message string) bool {
+	notification, ok := parseNotification(message)
+	if !ok {
+		return true
+	}
+	for _, event := range e.handledEvents() {
+		if notification.Event == event {
+			return true
+		}
+	}
+	return false
+}
+
+// messageEvent returns the event of a notification, or the subject of
+// other messages.
+func messageEvent(msgBody *snsMsg) string {
+	notification, ok := parseNotification(msgBody.Message)
+	if ok {
+		return notification.Event
+	}
+	if msgBody.Subject != "" {
+		return msgBody.Subject
+	}
+	return msgBody.Type
+}
+
+// cacheReady reports whether every region holds a cached instance list for
+// every group, which is required to apply a notification incrementally.
+func cacheReady(regionClients []*regionClient, groupNames []string) bool {
+	for _, rc := range regionClients {
+		for _, groupName := range groupNames {
+			if _, ok := rc.lastInstances[groupName]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func cachedInstances(regionClients []*regionClient, groupNames []string) map[string][]*internalInstance {
+	instances := make(map[string][]*internalInstance)
+	for _, groupName := range groupNames {
+		for _, rc := range regionClients {
+			instances[groupName] = append(instances[groupName], rc.lastInstances[groupName]...)
+		}
+	}
+	return instances
+}
+
+func removeInstance(instances []*internalInstance, instanceID string) []*internalInstance {
+	var kept []*internalInstance
+	for _, instance := range instances {
+		if instance.instanceID != instanceID {
+			kept = append(kept, instance)
+		}
+	}
+	return kept
+}
+
+func isInstanceNotFound(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == "InvalidInstanceID.NotFound"
+	}
+	return false
+}
+
+// describeLaunchedInstance looks up a single instance for a group, applying
+// the same selection rules as the full discovery.
+func describeLaunchedInstance(rc *regionClient, opts *discoveryOptions, groupName string, notification *autoScalingNotification) ([]*internalInstance, error) {
+	instanceIDs := []*string{aws.String(notification.EC2InstanceId)}
+
+	if opts.autoScalingGroupName == "" {
+		return getInstanceListFromGroup(rc, opts, groupName, instanceIDs)
+	}
+
+	var instances []*internalInstance
+	if notification.AutoScalingGroupName != groupName {
+		return instances, nil
+	}
+	reservations, err := describeInstances(rc, opts, &ec2.DescribeInstancesInput{
+		InstanceIds: instanceIDs,
+		Filters:     opts.instanceFilters(),
+	}, groupName)
+	if err != nil {
+		return nil, err
+	}
+	for _, reservation := range reservations {
+		for _, instance := range reservation.Instances {
+			if opts.isInstanceActive(instance) && opts.inNetwork(instance) {
+				instances = append(instances, newInternalInstance(instance, rc.region))
+			}
+		}
+	}
+	return instances, nil
+}
+
+// applyNotification updates the cached instance lists from an autoscaling
+// notification or instance state change. Terminations need no EC2 call at
+// all, launches describe just the new instance and check its status like the
+// full discovery does. It returns false whenever a full discovery is needed
+// instead, e.g. for unknown events or an empty cache.
+func applyNotification(regionClients []*regionClient, opts *discoveryOptions, groupNames []string, msgBody *snsMsg) bool {
+	notification, ok := parseNotification(msgBody.Message)
+	if !ok || notification.EC2InstanceId == "" || !cacheReady(regionClients, groupNames) {
+		return false
+	}
+
+	switch notification.Event {
+	case eventInstanceTerminate:
+		for _, rc := range regionClients {
+			for _, groupName := range groupNames {
+				rc.lastInstances[groupName] = removeInstance(rc.lastInstances[groupName], notification.EC2InstanceId)
+			}
+		}
+		log.Println("removed terminated instance from cache: ", notification.EC2InstanceId)
+		return true
+
+	case eventInstanceLaunch:
+		launched := make(map[*regionClient]map[string][]*internalInstance)
+		found := false
+		for _, rc := range regionClients {
+			launched[rc] = make(map[string][]*internalInstance)
+			for _, groupName := range groupNames {
+				instances, err := describeLaunchedInstance(rc, opts, groupName, notification)
+				if isInstanceNotFound(err) {
+					continue
+				}
+				if err == nil && opts.skipImpaired && len(instances) > 0 {
+					err = markImpaired(rc, opts, instances)
+				}
+				if err != nil {
+					log.Println("error when describing launched instance: ", err)
+					return false
+				}
+				for _, instance := range instances {
+					// let the full discovery wait for the address
+					if !instance.hasEndpoint(opts.endpointType) {
+						return false
+					}
+					found = true
+				}
+				launched[rc][groupName] = instances
+			}
+		}
+		if !found {
+			return false
+		}
+		for rc, groups := range launched {
+			for groupName, instances := range groups {
+				cached := removeInstance(rc.lastInstances[groupName], notification.EC2InstanceId)
+				rc.lastInstances[groupName] = append(cached, instances...)
+			}
+		}
+		log.Println("added launched instance to cache: ", notification.EC2InstanceId)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+const (
+	lifecycleTransitionTerminating = "autoscaling:EC2_INSTANCE_TERMINATING"
+
+	lifecycleActionContinue = "CONTINUE"
+	lifecycleActionAbandon  = "ABANDON"
+)
+
+// lifecycleNotification is the inner Message sent by an autoscaling
+// lifecycle hook.
+type lifecycleNotification struct {
+	LifecycleHookName    string
+	LifecycleActionToken string
+	LifecycleTransition  string
+	AutoScalingGroupName string
+	EC2InstanceId        string
+}
+
+// parseLifecycleNotification parses a terminating lifecycle hook
+// notification, other transitions aren't waited on.
+func parseLifecycleNotification(message string) (*lifecycleNotification, bool) {
+	notification := &lifecycleNotification{}
+	err := json.Unmarshal([]byte(message), notification)
+	if err != nil || notification.LifecycleActionToken == "" ||
+		notification.LifecycleTransition != lifecycleTransitionTerminating {
+		return nil, false
+	}
+	return notification, true
+}
+
+// notification maps the lifecycle action onto a termination, so the
+// instance is removed before the hook is completed.
+func (n *lifecycleNotification) notification() *autoScalingNotification {
+	return &autoScalingNotification{
+		Event:                eventInstanceTerminate,
+		AutoScalingGroupName: n.AutoScalingGroupName,
+		EC2InstanceId:        n.EC2InstanceId,
+	}
+}
+
+// waitForRemoval queues the lifecycle action until an update applies a
+// config without the instance.
+func (u *configUpdater) waitForRemoval(notification *lifecycleNotification) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.lifecycles = append(u.lifecycles, notification)
+}
+
+// settledLifecycleActions takes the queued lifecycle actions an update
+// settled: all of them when it failed, otherwise the ones whose instance
+// isn't in the applied config anymore. A deferred update settles none, nor
+// does one that still has the instance, e.g. because discovery lists it
+// until it's terminated. Must be called with mu held.
+func (u *configUpdater) settledLifecycleActions(updateErr error) []*lifecycleNotification {
+	if len(u.lifecycles) == 0 {
+		return nil
+	}
+	if updateErr != nil {
+		settled := u.lifecycles
+		u.lifecycles = nil
+		return settled
+	}
+	present := make(map[string]bool)
+	for _, items := range u.lastConfig {
+		for _, item := range items {
+			present[item.InstanceID] = true
+		}
+	}
+	var settled, waiting []*lifecycleNotification
+	for _, notification := range u.lifecycles {
+		if present[notification.EC2InstanceId] {
+			waiting = append(waiting, notification)
+		} else {
+			settled = append(settled, notification)
+		}
+	}
+	u.lifecycles = waiting
+	return settled
+}
+
+// completeLifecycleAction lets the termination continue once the config
+// without the instance is applied. When applying failed the action is
+// abandoned if AWS_LIFECYCLE_ABANDON_ON_FAILURE is set, otherwise the hook
+// is left to time out.
+func (u *configUpdater) completeLifecycleAction(notification *lifecycleNotification, updateErr error) {
+	result := lifecycleActionContinue
+	if updateErr != nil {
+		if !u.environ.AwsLifecycleAbandonOnFailure {
+			log.Println("leaving lifecycle action to time out for instance: ", notification.EC2InstanceId)
+			return
+		}
+		result = lifecycleActionAbandon
+	}
+
+	var err error
+	for _, rc := range u.regionClients {
+		_, err = rc.autoScalingClient.CompleteLifecycleAction(&autoscaling.CompleteLifecycleActionInput{
+			AutoScalingGroupName:  aws.String(notification.AutoScalingGroupName),
+			LifecycleHookName:     aws.String(notification.LifecycleHookName),
+			LifecycleActionToken:  aws.String(notification.LifecycleActionToken),
+			LifecycleActionResult: aws.String(result),
+			InstanceId:            aws.String(notification.EC2InstanceId),
+		})
+		if err == nil {
+			log.Printf("completed lifecycle action for instance %v with %v\n", notification.EC2InstanceId, result)
+			return
+		}
+	}
+	log.Println("error when completing lifecycle action: ", err)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultLockTimeout = 30 * time.Second
+	lockPollInterval   = 100 * time.Millisecond
+)
+
+// configLock is an exclusive flock on a file next to the config, held while
+// the config is written and haproxy reloaded, so two instances on the same
+// host can't interleave.
+type configLock struct {
+	path string
+	// timeout is how long to wait for another holder, 0 fails right away
+	timeout time.Duration
+}
+
+// newConfigLock returns the lock for the installed haproxy config at
+// configPath, which is also set when only render pairs are configured.
+func newConfigLock(environ *env, configPath string) *configLock {
+	l := &configLock{
+		path:    configPath + ".lock",
+		timeout: defaultLockTimeout,
+	}
+	if environ.HaproxyLockTimeoutSeconds > 0 {
+		l.timeout = time.Duration(environ.HaproxyLockTimeoutSeconds) * time.Second
+	}
+	if environ.HaproxyLockNoWait {
+		l.timeout = 0
+	}
+	return l
+}
+
+// acquire takes the lock and returns the function releasing it.
+func (l *configLock) acquire() (func(), error) {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(l.timeout)
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			return nil, err
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			return nil, permanentError{fmt.Errorf("another instance holds the lock on %v", l.path)}
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
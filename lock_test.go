@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigLockContends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// only render pairs configured, HAPROXY_FILE_DEST is empty
+	environ := &env{HaproxyLockNoWait: true}
+	configPath := filepath.Join(dir, "haproxy.cfg")
+	first := newConfigLock(environ, configPath)
+	if first.path != configPath+".lock" {
+		t.Errorf("lock path = %v, want %v", first.path, configPath+".lock")
+	}
+
+	unlock, err := first.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newConfigLock(environ, configPath).acquire()
+	if err == nil || !isPermanent(err) {
+		t.Errorf("second acquire() error = %v, want a permanent lock error", err)
+	}
+	unlock()
+
+	unlock, err = newConfigLock(environ, configPath).acquire()
+	if err != nil {
+		t.Errorf("acquire() after unlock error = %v", err)
+	} else {
+		unlock()
+	}
+}
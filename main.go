@@ -1,38 +1,210 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/exec"
-	"text/template"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/tomazk/envcfg"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/ssm"
 )
 
-const defaultWaitTimeSeconds = 10
+const (
+	defaultWaitTimeSeconds = 10
+	defaultGroupTagKey     = "group"
+	defaultPortTagKey      = "haproxy-port"
+	defaultPort            = 80
+	defaultWeightTagKey    = "haproxy-weight"
+	defaultWeight          = 1
+	maxWeight              = 256
+	defaultMaintTagKey     = "haproxy:state"
+	defaultMaintTagValue   = "maint"
 
-var haProxyTemplate = template.Must(
-	template.ParseFiles("haproxy.cfg.template"),
+	defaultAddressRetryAttempts = 3
+	defaultAddressRetryInterval = 2 * time.Second
+	defaultMaxRetries           = 5
+	localAZAuto                 = "auto"
+	rawDeliveryAuto             = "auto"
+	defaultShutdownTimeout      = 30 * time.Second
+	defaultServiceName          = "default"
+	defaultRetryTimeout         = 30 * time.Second
+	defaultReloadTimeout        = 30 * time.Second
+	reloadRetryDelay            = 2 * time.Second
+	maxCommandOutput            = 4096
+
+	endpointTypeIP        = "ip"
+	endpointTypeDNS       = "dns"
+	endpointTypePublicIP  = "public-ip"
+	endpointTypePublicDNS = "public-dns"
+	endpointTypeIPv6      = "ipv6"
+	endpointTypeIPv6First = "ipv6-prefer"
 )
 
 type env struct {
-	AwsAccessKeyID      string `envcfg:"AWS_ACCESS_KEY_ID" envcfgkeep:""`
-	AwsSecretAccessKey  string `envcfg:"AWS_SECRET_ACCESS_KEY" envcfgkeep:""`
-	AwsSqsRegion        string `envcfg:"AWS_SQS_REGION"`
-	AwsSqsQueueName     string `envcfg:"AWS_SQS_QUEUE_NAME"`
-	AwsSnsTopicName     string `envcfg:"AWS_SNS_TOPIC_NAME"`
-	AwsEC2GroupName     string `envcfg:"AWS_EC2_GROUP_NAME"`
-	HaproxyFileDest     string `envcfg:"HAPROXY_FILE_DEST"`
-	HaproxyReloadScript string `envcfg:"HAPROXY_RELOAD_SCRIPT"`
+	AwsAccessKeyID                  string `envcfg:"AWS_ACCESS_KEY_ID" envcfgkeep:""`
+	AwsSecretAccessKey              string `envcfg:"AWS_SECRET_ACCESS_KEY" envcfgkeep:""`
+	AwsSqsRegion                    string `envcfg:"AWS_SQS_REGION"`
+	AwsEC2Regions                   string `envcfg:"AWS_EC2_REGIONS"`
+	AwsEC2AssumeRoleArn             string `envcfg:"AWS_EC2_ASSUME_ROLE_ARN"`
+	AwsEC2AssumeRoleExternalID      string `envcfg:"AWS_EC2_ASSUME_ROLE_EXTERNAL_ID"`
+	AwsEC2KeepStaleRegions          bool   `envcfg:"AWS_EC2_KEEP_STALE_REGIONS"`
+	AwsEC2AddressRetryAttempts      int    `envcfg:"AWS_EC2_ADDRESS_RETRY_ATTEMPTS"`
+	AwsEC2AddressRetryInterval      int    `envcfg:"AWS_EC2_ADDRESS_RETRY_INTERVAL"`
+	AwsEC2MaxRetries                int    `envcfg:"AWS_EC2_MAX_RETRIES"`
+	AwsEC2RetryTimeout              int    `envcfg:"AWS_EC2_RETRY_TIMEOUT"`
+	AwsLocalAZ                      string `envcfg:"AWS_LOCAL_AZ"`
+	AwsSkipImpaired                 bool   `envcfg:"AWS_SKIP_IMPAIRED"`
+	AwsImpairedDisable              bool   `envcfg:"AWS_IMPAIRED_DISABLE"`
+	AwsSqsQueueName                 string `envcfg:"AWS_SQS_QUEUE_NAME"`
+	AwsSqsQueueOwnerAccountID       string `envcfg:"AWS_SQS_QUEUE_OWNER_ACCOUNT_ID"`
+	AwsSqsQueueURL                  string `envcfg:"AWS_SQS_QUEUE_URL"`
+	AwsSqsQueueNames                string `envcfg:"AWS_SQS_QUEUE_NAMES"`
+	AwsSqsDedupSize                 int    `envcfg:"AWS_SQS_DEDUP_SIZE"`
+	AwsSqsDedupTTL                  int    `envcfg:"AWS_SQS_DEDUP_TTL"`
+	AwsSqsBatchSize                 int    `envcfg:"AWS_SQS_BATCH_SIZE"`
+	AwsSqsMaxReceiveFailures        int    `envcfg:"AWS_SQS_MAX_RECEIVE_FAILURES"`
+	MaxReceiveCount                 int    `envcfg:"MAX_RECEIVE_COUNT"`
+	AwsSqsDeadLetterQueueName       string `envcfg:"AWS_SQS_DEAD_LETTER_QUEUE_NAME"`
+	SqsWaitTimeSeconds              string `envcfg:"SQS_WAIT_TIME_SECONDS"`
+	SqsVisibilityTimeoutSeconds     string `envcfg:"SQS_VISIBILITY_TIMEOUT_SECONDS"`
+	SqsQueuePerHost                 bool   `envcfg:"SQS_QUEUE_PER_HOST"`
+	SqsQueuePrefix                  string `envcfg:"SQS_QUEUE_PREFIX"`
+	SqsRawDelivery                  string `envcfg:"SQS_RAW_DELIVERY"`
+	AwsEventBridgeAccountID         string `envcfg:"AWS_EVENTBRIDGE_ACCOUNT_ID"`
+	Bootstrap                       bool   `envcfg:"BOOTSTRAP"`
+	ShutdownTimeoutSeconds          int    `envcfg:"SHUTDOWN_TIMEOUT_SECONDS"`
+	SyncIntervalSeconds             int    `envcfg:"SYNC_INTERVAL_SECONDS"`
+	MaxMessageAgeSeconds            int    `envcfg:"MAX_MESSAGE_AGE_SECONDS"`
+	MaxDrainSeconds                 int    `envcfg:"MAX_DRAIN_SECONDS"`
+	SpotInterruptionAction          string `envcfg:"SPOT_INTERRUPTION_ACTION"`
+	AwsSnsTopicName                 string `envcfg:"AWS_SNS_TOPIC_NAME"`
+	AwsSnsTopicArn                  string `envcfg:"AWS_SNS_TOPIC_ARN"`
+	AwsSnsSkipSignatureVerification bool   `envcfg:"AWS_SNS_SKIP_SIGNATURE_VERIFICATION"`
+	AwsEC2GroupName                 string `envcfg:"AWS_EC2_GROUP_NAME"`
+	AwsEC2GroupNames                string `envcfg:"AWS_EC2_GROUP_NAMES"`
+	AwsEC2GroupTagKey               string `envcfg:"AWS_EC2_GROUP_TAG_KEY"`
+	AwsEC2ExtraTagFilters           string `envcfg:"AWS_EC2_EXTRA_TAG_FILTERS"`
+	AwsEC2VpcID                     string `envcfg:"AWS_EC2_VPC_ID"`
+	AwsEC2SubnetIDs                 string `envcfg:"AWS_EC2_SUBNET_IDS"`
+	AwsEC2InstanceStates            string `envcfg:"AWS_EC2_INSTANCE_STATES"`
+	AwsAutoScalingGroupName         string `envcfg:"AWS_AUTOSCALING_GROUP_NAME"`
+	AwsEC2PeersGroupName            string `envcfg:"AWS_EC2_PEERS_GROUP_NAME"`
+	AwsTargetGroupArn               string `envcfg:"AWS_TARGET_GROUP_ARN"`
+	HaproxyPeersPort                int    `envcfg:"HAPROXY_PEERS_PORT"`
+	HaproxyPeersPortTagKey          string `envcfg:"HAPROXY_PEERS_PORT_TAG_KEY"`
+	AwsAutoScalingEvents            string `envcfg:"AWS_AUTOSCALING_EVENTS"`
+	AwsLifecycleAbandonOnFailure    bool   `envcfg:"AWS_LIFECYCLE_ABANDON_ON_FAILURE"`
+	AwsEC2PortTagKey                string `envcfg:"AWS_EC2_PORT_TAG_KEY"`
+	AwsEC2WeightTagKey              string `envcfg:"AWS_EC2_WEIGHT_TAG_KEY"`
+	AwsEC2MaintTagKey               string `envcfg:"AWS_EC2_MAINT_TAG_KEY"`
+	AwsEC2MaintTagValue             string `envcfg:"AWS_EC2_MAINT_TAG_VALUE"`
+	AwsEC2ServiceTagKey             string `envcfg:"AWS_EC2_SERVICE_TAG_KEY"`
+	AwsInstanceTypeWeights          string `envcfg:"AWS_INSTANCE_TYPE_WEIGHTS"`
+	AwsInstanceWarmupSeconds        int    `envcfg:"AWS_INSTANCE_WARMUP_SECONDS"`
+	HaproxyFileDest                 string `envcfg:"HAPROXY_FILE_DEST"`
+	HaproxyFileMode                 string `envcfg:"HAPROXY_FILE_MODE"`
+	HaproxyFileOwner                string `envcfg:"HAPROXY_FILE_OWNER"`
+	HaproxyFileGroup                string `envcfg:"HAPROXY_FILE_GROUP"`
+	BackendsJSONDest                string `envcfg:"BACKENDS_JSON_DEST"`
+	HaproxyStateFileDest            string `envcfg:"HAPROXY_STATE_FILE_DEST"`
+	HaproxyHistoryDir               string `envcfg:"HAPROXY_HISTORY_DIR"`
+	HaproxyHistoryKeep              int    `envcfg:"HAPROXY_HISTORY_KEEP"`
+	MinBackendServers               int    `envcfg:"MIN_BACKEND_SERVERS"`
+	AllowEmptyBackends              bool   `envcfg:"ALLOW_EMPTY_BACKENDS"`
+	MaxRemovalFraction              string `envcfg:"MAX_REMOVAL_FRACTION"`
+	CanaryMaxUnreachableFraction    string `envcfg:"CANARY_MAX_UNREACHABLE_FRACTION"`
+	CanaryRetrySeconds              int    `envcfg:"CANARY_RETRY_SECONDS"`
+	HaproxyReloadScript             string `envcfg:"HAPROXY_RELOAD_SCRIPT"`
+	HaproxyReloadCommand            string `envcfg:"HAPROXY_RELOAD_COMMAND"`
+	HaproxyReloadMode               string `envcfg:"HAPROXY_RELOAD_MODE"`
+	HaproxySystemdUnit              string `envcfg:"HAPROXY_SYSTEMD_UNIT"`
+	HaproxyMasterSocket             string `envcfg:"HAPROXY_MASTER_SOCKET"`
+	HaproxyPidFile                  string `envcfg:"HAPROXY_PID_FILE"`
+	HaproxyRemoteHosts              string `envcfg:"HAPROXY_REMOTE_HOSTS"`
+	HaproxyRemoteKeyPath            string `envcfg:"HAPROXY_REMOTE_KEY_PATH"`
+	HaproxyRemoteHostKeyChecking    string `envcfg:"HAPROXY_REMOTE_HOST_KEY_CHECKING"`
+	HaproxyRemoteReloadCommand      string `envcfg:"HAPROXY_REMOTE_RELOAD_COMMAND"`
+	HaproxyPublishS3URL             string `envcfg:"HAPROXY_PUBLISH_S3_URL"`
+	SsmDocumentName                 string `envcfg:"SSM_DOCUMENT_NAME"`
+	SsmTargetTag                    string `envcfg:"SSM_TARGET_TAG"`
+	SsmRetries                      int    `envcfg:"SSM_RETRIES"`
+	SsmTimeoutSeconds               int    `envcfg:"SSM_TIMEOUT_SECONDS"`
+	DataplaneURL                    string `envcfg:"DATAPLANE_URL"`
+	DataplaneUser                   string `envcfg:"DATAPLANE_USER"`
+	DataplanePassword               string `envcfg:"DATAPLANE_PASSWORD"`
+	DataplaneToken                  string `envcfg:"DATAPLANE_TOKEN"`
+	DataplaneRetries                int    `envcfg:"DATAPLANE_RETRIES"`
+	DataplaneDryRun                 bool   `envcfg:"DATAPLANE_DRY_RUN"`
+	HaproxyNoReload                 bool   `envcfg:"HAPROXY_NO_RELOAD"`
+	HookPreWrite                    string `envcfg:"HOOK_PRE_WRITE"`
+	HookPostReload                  string `envcfg:"HOOK_POST_RELOAD"`
+	HookTimeoutSeconds              int    `envcfg:"HOOK_TIMEOUT_SECONDS"`
+	HaproxyReloadTimeoutSeconds     int    `envcfg:"HAPROXY_RELOAD_TIMEOUT_SECONDS"`
+	HaproxyReloadOKCodes            string `envcfg:"HAPROXY_RELOAD_OK_CODES"`
+	HaproxyReloadRetries            int    `envcfg:"HAPROXY_RELOAD_RETRIES"`
+	HaproxyMinReloadIntervalSeconds int    `envcfg:"HAPROXY_MIN_RELOAD_INTERVAL_SECONDS"`
+	HaproxyPostcheckAddr            string `envcfg:"HAPROXY_POSTCHECK_ADDR"`
+	HaproxyPostcheckSocket          string `envcfg:"HAPROXY_POSTCHECK_SOCKET"`
+	HaproxyPostcheckTimeoutSeconds  int    `envcfg:"HAPROXY_POSTCHECK_TIMEOUT_SECONDS"`
+	HaproxyRuntimeSocket            string `envcfg:"HAPROXY_RUNTIME_SOCKET"`
+	HaproxyDrainGraceSeconds        int    `envcfg:"HAPROXY_DRAIN_GRACE_SECONDS"`
+	HaproxyDrainWaitSeconds         int    `envcfg:"HAPROXY_DRAIN_WAIT_SECONDS"`
+	HaproxyDrainMaxSessions         int    `envcfg:"HAPROXY_DRAIN_MAX_SESSIONS"`
+	HaproxyTemplatePath             string `envcfg:"HAPROXY_TEMPLATE_PATH"`
+	HaproxyTemplatePollSeconds      int    `envcfg:"HAPROXY_TEMPLATE_POLL_SECONDS"`
+	HaproxyTemplateRequired         bool   `envcfg:"HAPROXY_TEMPLATE_REQUIRED"`
+	HaproxyTemplateSkipSelfTest     bool   `envcfg:"HAPROXY_TEMPLATE_SKIP_SELF_TEST"`
+	HaproxyTemplateStrict           bool   `envcfg:"HAPROXY_TEMPLATE_STRICT"`
+	HaproxyRenderPairs              string `envcfg:"HAPROXY_RENDER_PAIRS"`
+	HaproxyTemplateLegacyRoot       bool   `envcfg:"HAPROXY_TEMPLATE_LEGACY_ROOT"`
+	HaproxyTemplateEnvPrefix        string `envcfg:"HAPROXY_TEMPLATE_ENV_PREFIX"`
+	HaproxySecretsSSM               string `envcfg:"HAPROXY_SECRETS_SSM"`
+	HaproxySecretsEnvPrefix         string `envcfg:"HAPROXY_SECRETS_ENV_PREFIX"`
+	HaproxyCerts                    string `envcfg:"HAPROXY_CERTS"`
+	HaproxyMapFile                  string `envcfg:"HAPROXY_MAP_FILE"`
+	HaproxyMapDomainTagKey          string `envcfg:"HAPROXY_MAP_DOMAIN_TAG_KEY"`
+	HaproxyCheckCommand             string `envcfg:"HAPROXY_CHECK_COMMAND"`
+	ConfigCheckCommand              string `envcfg:"CONFIG_CHECK_COMMAND"`
+	HaproxyCheckDisabled            bool   `envcfg:"HAPROXY_CHECK_DISABLED"`
+	HaproxyCheckTimeoutSeconds      int    `envcfg:"HAPROXY_CHECK_TIMEOUT_SECONDS"`
+	HaproxyBackupCount              int    `envcfg:"HAPROXY_BACKUP_COUNT"`
+	HaproxyAlwaysReload             bool   `envcfg:"HAPROXY_ALWAYS_RELOAD"`
+	HaproxyHeaderDisabled           bool   `envcfg:"HAPROXY_HEADER_DISABLED"`
+	HaproxyLockTimeoutSeconds       int    `envcfg:"HAPROXY_LOCK_TIMEOUT_SECONDS"`
+	HaproxyLockNoWait               bool   `envcfg:"HAPROXY_LOCK_NO_WAIT"`
+	HaproxyDebounceSeconds          int    `envcfg:"HAPROXY_DEBOUNCE_SECONDS"`
+	HaproxyDebounceMaxSeconds       int    `envcfg:"HAPROXY_DEBOUNCE_MAX_SECONDS"`
+	HaproxyEndpointType             string `envcfg:"HAPROXY_ENDPOINT_TYPE"`
+	HaproxyDefaultPort              int    `envcfg:"HAPROXY_DEFAULT_PORT"`
+	HaproxyDefaultWeight            int    `envcfg:"HAPROXY_DEFAULT_WEIGHT"`
+	HaproxyMaintDisabled            bool   `envcfg:"HAPROXY_MAINT_DISABLED"`
+	HealthProbePort                 int    `envcfg:"HEALTH_PROBE_PORT"`
+	HealthProbeTimeout              int    `envcfg:"HEALTH_PROBE_TIMEOUT"`
+	HealthProbeWorkers              int    `envcfg:"HEALTH_PROBE_WORKERS"`
+	HealthProbeSkipUnreachable      bool   `envcfg:"HEALTH_PROBE_SKIP_UNREACHABLE"`
 }
 
 type snsMsg struct {
@@ -42,19 +214,389 @@ type snsMsg struct {
 	Timestamp time.Time
 	Subject   string
 	Message   string
+
+	SubscribeURL string
 }
 
 type internalInstance struct {
-	internalDNS  string
-	internalIP   string
-	instanceType string
-	instanceID   string
-	name         string
+	internalDNS      string
+	internalIP       string
+	publicDNS        string
+	publicIP         string
+	ipv6             string
+	availabilityZone string
+	impaired         bool
+	state            string
+	launchTime       time.Time
+	instanceType     string
+	instanceID       string
+	name             string
+	region           string
+	tags             map[string]string
 }
 
 type templateItem struct {
-	Name string
-	Host string
+	Name       string
+	ID         int // stable for an instance across reloads and restarts
+	InstanceID string
+	PrivateIP  string
+	PrivateDNS string
+	Host       string
+	Port       int
+	Address    string
+	Weight     int
+	// WeightSet is false when Weight is only the built-in default, so
+	// templates can leave it to haproxy
+	WeightSet bool
+	Disabled  bool
+	Healthy   bool
+	AZ        string
+	Backup    bool
+	Service   string
+	// Tags holds every EC2 tag of the instance
+	Tags map[string]string
+}
+
+type templateBackend struct {
+	Name    string
+	Service string
+	Servers []templateItem
+}
+
+// String returns the address, so a list of servers can be joined in a
+// template.
+func (i templateItem) String() string {
+	return i.Address
+}
+
+// templateData is the root object of the template.
+type templateData struct {
+	GeneratedAt time.Time
+	// Group is the comma separated list of groups the servers come from
+	Group string
+	// Servers holds the servers of all backends
+	Servers  []templateItem
+	Count    int
+	Backends []templateBackend
+	// Trigger describes the message or event the config was rendered for
+	Trigger string
+	// Peers holds the instances of AWS_EC2_PEERS_GROUP_NAME
+	Peers []templatePeer
+	// Secrets holds the values loaded by loadSecrets
+	Secrets secretValues
+}
+
+// splitList splits a comma separated env value, dropping empty entries.
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// groupNames returns the list of EC2 groups to discover. AWS_EC2_GROUP_NAMES
+// takes a comma separated list, AWS_EC2_GROUP_NAME is kept for backwards
+// compatibility when only a single group is used. When an auto scaling group
+// is configured it replaces the tag based groups.
+func (e *env) groupNames() []string {
+	if e.AwsAutoScalingGroupName != "" {
+		return []string{e.AwsAutoScalingGroupName}
+	}
+
+	names := splitList(e.AwsEC2GroupNames)
+	if len(names) == 0 && e.AwsEC2GroupName != "" {
+		names = append(names, e.AwsEC2GroupName)
+	}
+	return names
+}
+
+// groupTagKey returns the tag key used to match instances to a group.
+func (e *env) groupTagKey() string {
+	if e.AwsEC2GroupTagKey != "" {
+		return e.AwsEC2GroupTagKey
+	}
+	return defaultGroupTagKey
+}
+
+// portTagKey returns the tag key holding a per-instance backend port.
+func (e *env) portTagKey() string {
+	if e.AwsEC2PortTagKey != "" {
+		return e.AwsEC2PortTagKey
+	}
+	return defaultPortTagKey
+}
+
+// weightTagKey returns the tag key holding a per-instance server weight.
+func (e *env) weightTagKey() string {
+	if e.AwsEC2WeightTagKey != "" {
+		return e.AwsEC2WeightTagKey
+	}
+	return defaultWeightTagKey
+}
+
+// maintTagKey returns the tag key used to put an instance into maintenance.
+func (e *env) maintTagKey() string {
+	if e.AwsEC2MaintTagKey != "" {
+		return e.AwsEC2MaintTagKey
+	}
+	return defaultMaintTagKey
+}
+
+// maintTagValue returns the maintenance tag value that marks an instance.
+func (e *env) maintTagValue() string {
+	if e.AwsEC2MaintTagValue != "" {
+		return e.AwsEC2MaintTagValue
+	}
+	return defaultMaintTagValue
+}
+
+// addressRetryAttempts returns how many times a describe is attempted while
+// pending instances are still missing their address.
+func (e *env) addressRetryAttempts() int {
+	if e.AwsEC2AddressRetryAttempts > 0 {
+		return e.AwsEC2AddressRetryAttempts
+	}
+	return defaultAddressRetryAttempts
+}
+
+// addressRetryInterval returns the wait between those attempts.
+func (e *env) addressRetryInterval() time.Duration {
+	if e.AwsEC2AddressRetryInterval > 0 {
+		return time.Duration(e.AwsEC2AddressRetryInterval) * time.Second
+	}
+	return defaultAddressRetryInterval
+}
+
+// maxRetries returns how often a throttled EC2 call is retried.
+func (e *env) maxRetries() int {
+	if e.AwsEC2MaxRetries > 0 {
+		return e.AwsEC2MaxRetries
+	}
+	return defaultMaxRetries
+}
+
+// retryTimeout returns the overall time allowed for retrying an EC2 call.
+func (e *env) retryTimeout() time.Duration {
+	if e.AwsEC2RetryTimeout > 0 {
+		return time.Duration(e.AwsEC2RetryTimeout) * time.Second
+	}
+	return defaultRetryTimeout
+}
+
+// instanceStates returns the instance states that are picked up, running
+// and pending by default.
+func (e *env) instanceStates() []string {
+	states := splitList(e.AwsEC2InstanceStates)
+	if len(states) == 0 {
+		states = []string{ec2.InstanceStateNameRunning, ec2.InstanceStateNamePending}
+	}
+	return states
+}
+
+// discoveryOptions holds the parsed settings used to select instances.
+type discoveryOptions struct {
+	groupTagKey          string
+	extraTagFilters      []*ec2.Filter
+	autoScalingGroupName string
+	endpointType         string
+	portTagKey           string
+	defaultPort          int
+	weightTagKey         string
+	defaultWeight        int
+	defaultWeightSet     bool
+	typeWeights          map[string]int
+	maintTagKey          string
+	maintTagValue        string
+	maintDisabled        bool
+	keepStaleRegions     bool
+	vpcID                string
+	subnetIDs            []string
+	addressRetryAttempts int
+	addressRetryInterval time.Duration
+	maxRetries           int
+	retryTimeout         time.Duration
+	probe                *probeOptions
+	localAZ              string
+	skipImpaired         bool
+	impairedDisable      bool
+	instanceStates       []string
+	serviceTagKey        string
+	warmup               *warmupTracker
+	serverIDs            *serverIDTracker
+	interruptions        *interruptionTracker
+	peersGroupName       string
+	peersPort            int
+	peersPortTagKey      string
+	localInstanceID      string
+}
+
+func newDiscoveryOptions(environ *env) (*discoveryOptions, error) {
+	extraTagFilters, err := parseTagFilters(environ.AwsEC2ExtraTagFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	endpointType := environ.HaproxyEndpointType
+	if endpointType == "" {
+		endpointType = endpointTypeIP
+	}
+	switch endpointType {
+	case endpointTypeIP, endpointTypeDNS, endpointTypePublicIP, endpointTypePublicDNS,
+		endpointTypeIPv6, endpointTypeIPv6First:
+	default:
+		return nil, fmt.Errorf("invalid HAPROXY_ENDPOINT_TYPE %q, expected one of %q, %q, %q, %q, %q, %q",
+			endpointType, endpointTypeIP, endpointTypeDNS, endpointTypePublicIP, endpointTypePublicDNS,
+			endpointTypeIPv6, endpointTypeIPv6First)
+	}
+
+	port := environ.HaproxyDefaultPort
+	if port == 0 {
+		port = defaultPort
+	}
+	if !isValidPort(port) {
+		return nil, fmt.Errorf("invalid HAPROXY_DEFAULT_PORT %d", port)
+	}
+
+	weight := environ.HaproxyDefaultWeight
+	if weight == 0 {
+		weight = defaultWeight
+	}
+	if !isValidWeight(weight) {
+		return nil, fmt.Errorf("invalid HAPROXY_DEFAULT_WEIGHT %d", weight)
+	}
+
+	typeWeights, err := parseTypeWeights(environ.AwsInstanceTypeWeights)
+	if err != nil {
+		return nil, err
+	}
+
+	interruptions, err := newInterruptionTracker(environ)
+	if err != nil {
+		return nil, err
+	}
+	return &discoveryOptions{
+		groupTagKey:          environ.groupTagKey(),
+		extraTagFilters:      extraTagFilters,
+		autoScalingGroupName: environ.AwsAutoScalingGroupName,
+		endpointType:         endpointType,
+		portTagKey:           environ.portTagKey(),
+		defaultPort:          port,
+		weightTagKey:         environ.weightTagKey(),
+		defaultWeight:        weight,
+		defaultWeightSet:     environ.HaproxyDefaultWeight != 0,
+		typeWeights:          typeWeights,
+		maintTagKey:          environ.maintTagKey(),
+		maintTagValue:        environ.maintTagValue(),
+		maintDisabled:        environ.HaproxyMaintDisabled,
+		keepStaleRegions:     environ.AwsEC2KeepStaleRegions,
+		vpcID:                environ.AwsEC2VpcID,
+		subnetIDs:            splitList(environ.AwsEC2SubnetIDs),
+		addressRetryAttempts: environ.addressRetryAttempts(),
+		addressRetryInterval: environ.addressRetryInterval(),
+		maxRetries:           environ.maxRetries(),
+		retryTimeout:         environ.retryTimeout(),
+		probe:                newProbeOptions(environ),
+		localAZ:              environ.AwsLocalAZ,
+		peersGroupName:       environ.AwsEC2PeersGroupName,
+		peersPort:            environ.peersPort(),
+		peersPortTagKey:      environ.peersPortTagKey(),
+		skipImpaired:         environ.AwsSkipImpaired,
+		impairedDisable:      environ.AwsImpairedDisable,
+		instanceStates:       environ.instanceStates(),
+		serviceTagKey:        environ.AwsEC2ServiceTagKey,
+		warmup:               newWarmupTracker(environ),
+		serverIDs:            &serverIDTracker{},
+		interruptions:        interruptions,
+	}, nil
+}
+
+// parseTagFilters turns "key=value,key2=value2" into EC2 tag filters. Values
+// may contain "=" but not ",", since the comma separates the pairs.
+func parseTagFilters(raw string) ([]*ec2.Filter, error) {
+	var filters []*ec2.Filter
+	if strings.TrimSpace(raw) == "" {
+		return filters, nil
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid tag filter %q, expected key=value (values can't contain commas)", pair)
+		}
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if key == "" || value == "" {
+			return nil, fmt.Errorf("invalid tag filter %q, key and value must not be empty", pair)
+		}
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: []*string{aws.String(value)},
+		})
+	}
+	return filters, nil
+}
+
+// instanceFilters returns the instance-state-name filter together with the
+// vpc-id and subnet-id filters, if configured.
+func (o *discoveryOptions) instanceFilters() []*ec2.Filter {
+	filters := []*ec2.Filter{
+		{
+			Name:   aws.String("instance-state-name"),
+			Values: aws.StringSlice(o.instanceStates),
+		},
+	}
+	if o.vpcID != "" {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("vpc-id"),
+			Values: []*string{aws.String(o.vpcID)},
+		})
+	}
+	if len(o.subnetIDs) > 0 {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("subnet-id"),
+			Values: aws.StringSlice(o.subnetIDs),
+		})
+	}
+	return filters
+}
+
+// inNetwork double checks the instance against the configured VPC and
+// subnets, so nothing outside of them ends up in the config.
+func (o *discoveryOptions) inNetwork(instance *ec2.Instance) bool {
+	if o.vpcID != "" && aws.StringValue(instance.VpcId) != o.vpcID {
+		return false
+	}
+	if len(o.subnetIDs) == 0 {
+		return true
+	}
+	for _, subnetID := range o.subnetIDs {
+		if aws.StringValue(instance.SubnetId) == subnetID {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTypeWeights parses the AWS_INSTANCE_TYPE_WEIGHTS JSON map of
+// instance type to server weight.
+func parseTypeWeights(raw string) (map[string]int, error) {
+	typeWeights := make(map[string]int)
+	if strings.TrimSpace(raw) == "" {
+		return typeWeights, nil
+	}
+	err := json.Unmarshal([]byte(raw), &typeWeights)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AWS_INSTANCE_TYPE_WEIGHTS: %v", err)
+	}
+	for instanceType, weight := range typeWeights {
+		if !isValidWeight(weight) {
+			return nil, fmt.Errorf("invalid AWS_INSTANCE_TYPE_WEIGHTS weight %d for %v", weight, instanceType)
+		}
+	}
+	return typeWeights, nil
 }
 
 func (i *internalInstance) getName() string {
@@ -64,131 +606,1106 @@ func (i *internalInstance) getName() string {
 	return i.instanceType + i.instanceID
 }
 
-func (i *internalInstance) getEndpoint() string {
-	// TODO: make this cleaner
-	return i.internalIP
+// getEndpoint returns the address haproxy should use to reach the instance.
+// Public and IPv6 endpoint types have no fallback, an instance without such
+// an address can't be reached and results in an error.
+func (i *internalInstance) getEndpoint(endpointType string) (string, error) {
+	switch endpointType {
+	case endpointTypePublicIP:
+		if i.publicIP == "" {
+			return "", fmt.Errorf("instance %v has no public IP", i.instanceID)
+		}
+		return i.publicIP, nil
+	case endpointTypePublicDNS:
+		if i.publicDNS == "" {
+			return "", fmt.Errorf("instance %v has no public DNS name", i.instanceID)
+		}
+		return i.publicDNS, nil
+	case endpointTypeIPv6:
+		if i.ipv6 == "" {
+			return "", fmt.Errorf("instance %v has no IPv6 address", i.instanceID)
+		}
+		return i.ipv6, nil
+	case endpointTypeIPv6First:
+		if i.ipv6 != "" {
+			return i.ipv6, nil
+		}
+	case endpointTypeDNS:
+		if i.internalDNS != "" {
+			return i.internalDNS, nil
+		}
+		log.Printf("warning: instance %v has no private DNS name, falling back to IP\n", i.instanceID)
+	}
+	return i.internalIP, nil
+}
+
+// hasEndpoint reports whether the instance has the address getEndpoint
+// returns for the endpoint type.
+func (i *internalInstance) hasEndpoint(endpointType string) bool {
+	switch endpointType {
+	case endpointTypePublicIP:
+		return i.publicIP != ""
+	case endpointTypePublicDNS:
+		return i.publicDNS != ""
+	case endpointTypeIPv6:
+		return i.ipv6 != ""
+	case endpointTypeIPv6First:
+		return i.ipv6 != "" || i.internalIP != ""
+	case endpointTypeDNS:
+		return i.internalDNS != "" || i.internalIP != ""
+	}
+	return i.internalIP != ""
+}
+
+func isValidPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// getPort returns the port set in the instance's port tag, or defaultPort
+// when the tag is missing.
+func (i *internalInstance) getPort(portTagKey string, defaultPort int) (int, error) {
+	value, ok := i.tags[portTagKey]
+	if !ok {
+		return defaultPort, nil
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || !isValidPort(port) {
+		return 0, fmt.Errorf("invalid %v tag value %q on instance %v", portTagKey, value, i.instanceID)
+	}
+	return port, nil
+}
+
+func isValidWeight(weight int) bool {
+	return weight >= 0 && weight <= maxWeight
+}
+
+// getWeight returns the weight set in the instance's weight tag, falling back
+// to the weight configured for its instance type and then to the default
+// weight. Unparsable or out of range tag values are ignored. set is false
+// when none of them was configured and the built-in default is used.
+func (i *internalInstance) getWeight(opts *discoveryOptions) (weight int, set bool) {
+	fallback, fallbackSet := opts.defaultWeight, opts.defaultWeightSet
+	if typeWeight, ok := opts.typeWeights[i.instanceType]; ok {
+		fallback, fallbackSet = typeWeight, true
+	}
+
+	value, ok := i.tags[opts.weightTagKey]
+	if !ok {
+		return fallback, fallbackSet
+	}
+	weight, err := strconv.Atoi(value)
+	if err != nil || !isValidWeight(weight) {
+		log.Printf("invalid %v tag value %q on instance %v, using weight %d\n",
+			opts.weightTagKey, value, i.instanceID, fallback)
+		return fallback, fallbackSet
+	}
+	return weight, true
+}
+
+// getService returns the value of the service tag, instances without it
+// belong to the default service.
+func (i *internalInstance) getService(serviceTagKey string) string {
+	if value := i.tags[serviceTagKey]; serviceTagKey != "" && value != "" {
+		return value
+	}
+	return defaultServiceName
+}
+
+func (i *internalInstance) inMaintenance(maintTagKey, maintTagValue string) bool {
+	value, ok := i.tags[maintTagKey]
+	return ok && value == maintTagValue
+}
+
+func (e *env) reloadTimeout() time.Duration {
+	if e.HaproxyReloadTimeoutSeconds > 0 {
+		return time.Duration(e.HaproxyReloadTimeoutSeconds) * time.Second
+	}
+	return defaultReloadTimeout
+}
+
+// reloadContext tells the reload script what changed and why.
+type reloadContext struct {
+	configPath   string
+	reason       string
+	serverCount  int
+	generationID string
+}
+
+func newReloadContext(data templateData) reloadContext {
+	return reloadContext{
+		configPath:   haProxyTemplates[0].dest,
+		reason:       data.Trigger,
+		serverCount:  data.Count,
+		generationID: strconv.FormatInt(data.GeneratedAt.UnixNano(), 10),
+	}
+}
+
+// environment returns the variables the reload script runs with, on top of
+// the ones of this process.
+func (c reloadContext) environment() []string {
+	return append(os.Environ(),
+		"HAPROXY_CONFIG_PATH="+c.configPath,
+		"HAPROXY_CHANGE_REASON="+c.reason,
+		"HAPROXY_SERVER_COUNT="+strconv.Itoa(c.serverCount),
+		"HAPROXY_GENERATION_ID="+c.generationID,
+	)
+}
+
+// validateReload rejects setting both HAPROXY_RELOAD_SCRIPT and
+// HAPROXY_RELOAD_COMMAND.
+func (e *env) validateReload() error {
+	if e.HaproxyReloadScript != "" && e.HaproxyReloadCommand != "" {
+		return fmt.Errorf("HAPROXY_RELOAD_SCRIPT and HAPROXY_RELOAD_COMMAND are mutually exclusive")
+	}
+	switch e.reloadMode() {
+	case reloadModeScript, reloadModeSystemd:
+	case reloadModeMaster:
+		if e.HaproxyMasterSocket == "" {
+			return fmt.Errorf("HAPROXY_RELOAD_MODE=master requires HAPROXY_MASTER_SOCKET")
+		}
+	default:
+		return fmt.Errorf("invalid HAPROXY_RELOAD_MODE %q, expected script, systemd or master", e.HaproxyReloadMode)
+	}
+	_, err := e.reloadOKCodes()
+	return err
+}
+
+// reloadOKCodes returns the exit codes of the reload that mean success,
+// HAPROXY_RELOAD_OK_CODES or just 0.
+func (e *env) reloadOKCodes() ([]int, error) {
+	if e.HaproxyReloadOKCodes == "" {
+		return []int{0}, nil
+	}
+	var codes []int
+	for _, item := range splitList(e.HaproxyReloadOKCodes) {
+		code, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HAPROXY_RELOAD_OK_CODES %q: %v", e.HaproxyReloadOKCodes, err)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// exitCode returns the exit code of a command that ran to completion and
+// failed, or -1 when it didn't get that far.
+func exitCode(err error) int {
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// reloadDisabled reports whether the config is only written, never
+// reloaded, which is the case when no reload is configured.
+func (e *env) reloadDisabled() bool {
+	if e.HaproxyNoReload {
+		return true
+	}
+	return e.reloadMode() == reloadModeScript && e.HaproxyReloadScript == "" && e.HaproxyReloadCommand == ""
+}
+
+// reloadArgs returns the command line of the reload. HAPROXY_RELOAD_COMMAND
+// runs through sh -c, with the config path as $1 like for the script.
+func (e *env) reloadArgs(configPath string) []string {
+	if e.HaproxyReloadCommand != "" {
+		return []string{"sh", "-c", e.HaproxyReloadCommand, "sh", configPath}
+	}
+	return []string{e.HaproxyReloadScript, configPath}
+}
+
+// reloadHaproxy runs the reload command, killing it when it runs longer than
+// HAPROXY_RELOAD_TIMEOUT_SECONDS. It gets the config path as its argument.
+// With HAPROXY_RELOAD_MODE=systemd the unit is reloaded over D-Bus instead,
+// with HAPROXY_RELOAD_MODE=master through the master CLI.
+func reloadHaproxy(environ *env, rc reloadContext) error {
+	switch environ.reloadMode() {
+	case reloadModeSystemd:
+		return reloadSystemd(environ.systemdUnit(), environ.reloadTimeout())
+	case reloadModeMaster:
+		return reloadMaster(&runtimeSocket{path: environ.HaproxyMasterSocket, timeout: environ.reloadTimeout()})
+	}
+	name := environ.HaproxyReloadScript
+	if environ.HaproxyReloadCommand != "" {
+		name = environ.HaproxyReloadCommand
+	}
+	err := runCommand("reload", name, environ.reloadArgs(rc.configPath), environ.reloadTimeout(), rc)
+	if err == nil {
+		return nil
+	}
+	// validated at startup
+	okCodes, _ := environ.reloadOKCodes()
+	code := exitCode(err)
+	for _, ok := range okCodes {
+		if code == ok {
+			log.Printf("reload exit code %d is configured as success\n", code)
+			return nil
+		}
+	}
+	return err
 }
 
-func reloadHaproxy(pathToScript string) {
-	reloadCommand := exec.Command(pathToScript)
-	log.Println("executing: ", pathToScript)
+// runCommand runs args in its own process group, so the command and
+// everything it started can be killed when it runs longer than timeout.
+// kind and name only describe the command in the logs.
+func runCommand(kind, name string, args []string, timeout time.Duration, rc reloadContext) error {
+	command := exec.Command(args[0], args[1:]...)
+	command.Env = rc.environment()
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var output bytes.Buffer
+	command.Stdout = &output
+	command.Stderr = &output
+	log.Println("executing: ", name)
 
-	output, err := reloadCommand.CombinedOutput()
+	err := command.Start()
 	if err != nil {
-		log.Println("error when running:", err)
-		return
+		log.Printf("error when running %v: %v\n", name, err)
+		return err
+	}
+	timedOut := int32(0)
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		syscall.Kill(-command.Process.Pid, syscall.SIGKILL)
+	})
+	err = command.Wait()
+	timer.Stop()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		log.Printf("error: %v timed out after %v, killed %v: %v\n", kind, timeout, name, trimOutput(output.String()))
+		return fmt.Errorf("%v timed out after %v", kind, timeout)
+	}
+
+	log.Printf("command %v exited with status %d\n", name, command.ProcessState.ExitCode())
+	log.Printf("output of command %v: %v\n", name, trimOutput(output.String()))
+	return err
+}
+
+// trimOutput cuts command output down to maxCommandOutput bytes for the log.
+func trimOutput(output string) string {
+	if len(output) <= maxCommandOutput {
+		return output
+	}
+	return output[:maxCommandOutput] + fmt.Sprintf("... (%d bytes trimmed)", len(output)-maxCommandOutput)
+}
+
+// errReloadSuperseded is returned when a failed reload isn't retried because
+// a newer config is waiting to be applied.
+var errReloadSuperseded = errors.New("reload abandoned for a newer config")
+
+// reloadWithRetries runs the reload script and retries a failed run up to
+// HAPROXY_RELOAD_RETRIES times, doubling the delay between attempts.
+func reloadWithRetries(w *configWriter, environ *env, rc reloadContext) error {
+	delay := reloadRetryDelay
+	for attempt := 1; ; attempt++ {
+		previousPid := w.postCheck.pid()
+		previousPids := w.pidCheck.pids()
+		err := reloadHaproxy(environ, rc)
+		if err == nil {
+			err = w.postCheck.verify(previousPid)
+			if err == nil {
+				// a forced reload may not change the config
+				err = w.pidCheck.verify(previousPids, !w.force)
+			}
+			if err == nil {
+				return nil
+			}
+			log.Println("error when checking haproxy after reload: ", err)
+		}
+		log.Printf("reload attempt %d failed with exit code %d: %v\n", attempt, exitCode(err), err)
+		if attempt > environ.HaproxyReloadRetries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if w.superseded != nil && w.superseded() {
+			log.Println("newer config pending, abandoning reload retries")
+			return errReloadSuperseded
+		}
+	}
+}
+
+// rawDeliveryMode returns how message bodies are interpreted: "true" for raw
+// payloads, "false" for SNS envelopes and "auto" to detect it per message.
+// Raw payloads can't be verified, so envelopes are expected unless set. To
+// share a verified queue between SNS and EventBridge rules targeting it
+// directly, use "auto" with AWS_EVENTBRIDGE_ACCOUNT_ID, see trustRawMsg.
+func (e *env) rawDeliveryMode() (string, error) {
+	switch e.SqsRawDelivery {
+	case "":
+		return "false", nil
+	case "true", "false", rawDeliveryAuto:
+		return e.SqsRawDelivery, nil
+	}
+	return "", fmt.Errorf("invalid SQS_RAW_DELIVERY %q, expected true, false or auto", e.SqsRawDelivery)
+}
+
+// isRawMsg reports whether the body is a raw payload instead of an SNS
+// envelope, which always carries Type, MessageId and TopicArn.
+func isRawMsg(msg *sqs.Message, mode string) bool {
+	switch mode {
+	case "true":
+		return true
+	case "false":
+		return false
 	}
+	envelope := &snsMsg{}
+	err := json.Unmarshal([]byte(aws.StringValue(msg.Body)), envelope)
+	return err != nil || envelope.Type == "" || envelope.MessageID == "" || envelope.TopicArn == ""
+}
 
-	log.Printf("output of command %v: %v\n", pathToScript, string(output))
+// trustRawMsg reports whether a raw payload may be handled. It carries no
+// signature or topic, so in auto mode anyone able to send to the queue could
+// forge one; it's only trusted when raw delivery or skipping signature
+// verification was explicitly configured. In auto mode EC2 events from
+// EventBridge are accepted too, when they come from the configured account
+// and one of the discovery regions.
+func (e *env) trustRawMsg(mode string, body string) bool {
+	if mode == "true" || e.AwsSnsSkipSignatureVerification {
+		return true
+	}
+	return mode == rawDeliveryAuto && e.isTrustedEventBridgeEvent(body)
 }
 
-func validateMsg(msg *sqs.Message) bool {
-	// TODO: better valitation required
+// newRawMsg wraps a raw payload as a notification. It has no signature or
+// topic, so neither can be checked.
+func newRawMsg(msg *sqs.Message) (*snsMsg, bool) {
+	body := aws.StringValue(msg.Body)
+	if !json.Valid([]byte(body)) {
+		return nil, false
+	}
+	return &snsMsg{
+		Type:      "Notification",
+		MessageID: aws.StringValue(msg.MessageId),
+		Message:   body,
+	}, true
+}
+
+func validateMsg(msg *sqs.Message, environ *env) (*snsMsg, bool) {
 	msgBody := &snsMsg{}
 	err := json.Unmarshal([]byte(*msg.Body), &msgBody)
 	if err != nil {
 		log.Println(err)
+		return nil, false
+	}
+	if !environ.isTopicAllowed(msgBody.TopicArn) {
+		log.Println("warning: msg from unexpected topic: ", msgBody.TopicArn)
+		return nil, false
+	}
+	return msgBody, true
+}
+
+// isTopicAllowed checks the TopicArn of a message against AWS_SNS_TOPIC_ARN,
+// or against AWS_SNS_TOPIC_NAME when no full ARN is configured.
+func (e *env) isTopicAllowed(topicArn string) bool {
+	if topicArn == "" {
 		return false
 	}
+	if e.AwsSnsTopicArn != "" {
+		return topicArn == e.AwsSnsTopicArn
+	}
+	if e.AwsSnsTopicName != "" {
+		return strings.HasSuffix(topicArn, ":"+e.AwsSnsTopicName)
+	}
 	return true
 }
 
-func getEC2Config(ec2Client *ec2.EC2, awsEC2GroupName string) ([]templateItem, error) {
+// discoverInstances queries every region for the instances of each group.
+func discoverInstances(regionClients []*regionClient, opts *discoveryOptions, groupNames []string) (map[string][]*internalInstance, error) {
+
+	instances := make(map[string][]*internalInstance)
+	for _, groupName := range groupNames {
+		for _, rc := range regionClients {
+			regionInstances, err := rc.getInstanceList(opts, groupName)
+			if err != nil {
+				log.Printf("error when getting EC2 data in %v: %v\n", rc.region, err)
+				return nil, err
+			}
+			instances[groupName] = append(instances[groupName], regionInstances...)
+		}
+	}
+
+	return instances, nil
+}
+
+func getEC2Config(regionClients []*regionClient, opts *discoveryOptions, groupNames []string) (map[string][]templateItem, error) {
 
-	var templateList []templateItem
-	internalInstances, err := getInstanceListFromGroup(ec2Client, awsEC2GroupName)
+	instances, err := discoverInstances(regionClients, opts, groupNames)
 	if err != nil {
-		log.Println("error when getting EC2 data: ", err)
 		return nil, err
 	}
 
-	for _, instance := range internalInstances {
-		templateList = append(templateList, templateItem{
-			Name: instance.getName(),
-			Host: instance.getEndpoint(),
+	return newEC2Config(instances, opts, groupNames), nil
+}
+
+// newEC2Config turns the discovered instances into template items per group.
+func newEC2Config(instances map[string][]*internalInstance, opts *discoveryOptions, groupNames []string) map[string][]templateItem {
+
+	now := time.Now()
+	config := make(map[string][]templateItem)
+	for _, groupName := range groupNames {
+		var templateList []templateItem
+		for _, instance := range instances[groupName] {
+			if opts.warmup.isWarmingUp(instance, now) {
+				continue
+			}
+			host, err := instance.getEndpoint(opts.endpointType)
+			if err != nil {
+				log.Println("warning: skipping instance: ", err)
+				continue
+			}
+			port, err := instance.getPort(opts.portTagKey, opts.defaultPort)
+			if err != nil {
+				log.Println("skipping instance: ", err)
+				continue
+			}
+			disabled := false
+			if instance.inMaintenance(opts.maintTagKey, opts.maintTagValue) {
+				if !opts.maintDisabled {
+					log.Printf("skipping instance %v: tagged %v=%v\n",
+						instance.instanceID, opts.maintTagKey, opts.maintTagValue)
+					continue
+				}
+				log.Printf("disabling instance %v: tagged %v=%v\n",
+					instance.instanceID, opts.maintTagKey, opts.maintTagValue)
+				disabled = true
+			}
+			if !isInstanceServing(instance.state) {
+				log.Printf("disabling instance %v: in state %v\n", instance.instanceID, instance.state)
+				disabled = true
+			}
+			if opts.interruptions.isInterrupted(instance.instanceID, now) {
+				if opts.interruptions.action == spotInterruptionRemove {
+					log.Printf("skipping instance %v: spot interruption warning\n", instance.instanceID)
+					continue
+				}
+				log.Printf("disabling instance %v: spot interruption warning\n", instance.instanceID)
+				disabled = true
+			}
+			if instance.impaired {
+				if !opts.impairedDisable {
+					log.Printf("skipping instance %v: status checks impaired\n", instance.instanceID)
+					continue
+				}
+				log.Printf("disabling instance %v: status checks impaired\n", instance.instanceID)
+				disabled = true
+			}
+			weight, weightSet := instance.getWeight(opts)
+			templateList = append(templateList, templateItem{
+				Name:       instance.getName(),
+				InstanceID: instance.instanceID,
+				PrivateIP:  instance.internalIP,
+				PrivateDNS: instance.internalDNS,
+				Host:       host,
+				Port:       port,
+				Address:    net.JoinHostPort(host, strconv.Itoa(port)),
+				Weight:     weight,
+				WeightSet:  weightSet,
+				Disabled:   disabled,
+				Healthy:    true,
+				AZ:         instance.availabilityZone,
+				Backup:     opts.localAZ != "" && instance.availabilityZone != opts.localAZ,
+				Service:    instance.getService(opts.serviceTagKey),
+				Tags:       instance.tags,
+			})
+		}
+		if opts.probe.enabled() {
+			templateList = probeTemplateItems(templateList, opts.probe)
+		}
+		sortTemplateItems(templateList)
+		config[groupName] = templateList
+	}
+
+	return config
+}
+
+// sortTemplateItems orders servers by name and then host, so identical
+// instance sets always render to identical configs.
+func sortTemplateItems(items []templateItem) {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Name != items[j].Name {
+			return items[i].Name < items[j].Name
+		}
+		return items[i].Host < items[j].Host
+	})
+}
+
+// newTemplateData builds the template root with one backend per group,
+// keeping the order in which the groups were configured. When a service tag
+// is configured the servers of all groups are split into one backend per
+// service instead, ordered by service name.
+func newTemplateData(opts *discoveryOptions, groupNames []string, config map[string][]templateItem) templateData {
+	var peers []templatePeer
+	if opts.peersGroupName != "" {
+		peers = newPeers(opts, config[opts.peersGroupName])
+		groupNames = opts.backendGroups(groupNames)
+	}
+	config = uniqueServerNames(groupNames, config)
+	opts.serverIDs.assign(groupNames, config)
+	data := templateData{
+		GeneratedAt: time.Now().UTC(),
+		Group:       strings.Join(groupNames, ","),
+		Peers:       peers,
+		Secrets:     currentSecrets(),
+	}
+	for _, groupName := range groupNames {
+		data.Servers = append(data.Servers, config[groupName]...)
+	}
+	data.Count = len(data.Servers)
+
+	if opts.serviceTagKey == "" {
+		for _, groupName := range groupNames {
+			data.Backends = append(data.Backends, templateBackend{
+				Name:    groupName,
+				Service: defaultServiceName,
+				Servers: config[groupName],
+			})
+		}
+		return data
+	}
+
+	services := make(map[string][]templateItem)
+	var serviceNames []string
+	for _, groupName := range groupNames {
+		for _, item := range config[groupName] {
+			if _, ok := services[item.Service]; !ok {
+				serviceNames = append(serviceNames, item.Service)
+			}
+			services[item.Service] = append(services[item.Service], item)
+		}
+	}
+	sort.Strings(serviceNames)
+	for _, service := range serviceNames {
+		sortTemplateItems(services[service])
+		data.Backends = append(data.Backends, templateBackend{
+			Name:    service,
+			Service: service,
+			Servers: services[service],
 		})
 	}
+	return data
+}
 
-	return templateList, nil
+// errConfigUnchanged is returned by writeHaproxyConfig when every rendered
+// file matches its destination, so there's nothing to reload.
+var errConfigUnchanged = errors.New("config unchanged")
 
+// configWriter holds the settings for installing rendered configs.
+type configWriter struct {
+	checker     *configChecker
+	ownership   *fileOwnership
+	lock        *configLock
+	backupCount int
+	// force replaces the files even when they are unchanged
+	force      bool
+	legacyRoot bool
+	// header prepends the provenance header to the haproxy config
+	header bool
+	hooks  *hooks
+	// dataPlane, when set, replaces writing the config and reloading
+	dataPlane *dataPlaneClient
+	// postCheck, when set, verifies haproxy after every reload
+	postCheck *postCheck
+	pidCheck  *pidCheck
+	certs     *certInstaller
+	// hostMap, when set, is maintained instead of the config
+	hostMap *hostMap
+	// remotes and fleet, when set, get a copy of every config
+	remotes *remoteHosts
+	fleet   *ssmFleet
+	// runtime, when set, updates servers over the stats socket instead of
+	// reloading haproxy
+	runtime *runtimeSocket
+	// superseded reports whether a newer config is waiting, reloadPending
+	// makes it replace the files even when they match the abandoned one
+	superseded    func() bool
+	reloadPending bool
+	// reloadRequired skips the runtime update until haproxy was reloaded,
+	// e.g. as it only reads certificates on reload
+	reloadRequired bool
+	// stateServers are the servers of the last generation written to the
+	// server state file
+	stateServers map[string]bool
 }
 
-func writeHaproxyConfig(haproxyFileDest string, templateData []templateItem) error {
+func newConfigWriter(environ *env) (*configWriter, error) {
+	ownership, err := newFileOwnership(environ)
+	if err != nil {
+		return nil, err
+	}
+	remotes, err := newRemoteHosts(environ)
+	if err != nil {
+		return nil, err
+	}
+	var runtime *runtimeSocket
+	if environ.HaproxyRuntimeSocket != "" {
+		runtime = &runtimeSocket{path: environ.HaproxyRuntimeSocket}
+	}
+	return &configWriter{
+		checker:     newConfigChecker(environ),
+		ownership:   ownership,
+		lock:        newConfigLock(environ, haProxyTemplates[0].dest),
+		backupCount: environ.backupCount(),
+		force:       environ.HaproxyAlwaysReload,
+		legacyRoot:  environ.HaproxyTemplateLegacyRoot,
+		header:      !environ.HaproxyHeaderDisabled,
+		runtime:     runtime,
+		postCheck:   newPostCheck(environ),
+		pidCheck:    newPidCheck(environ),
+		remotes:     remotes,
+		hostMap:     newHostMap(environ),
+		hooks:       newHooks(environ),
+		dataPlane:   newDataPlaneClient(environ),
+	}, nil
+}
+
+// writeHaproxyConfig renders every template into a temporary file next to
+// its destination and renames them over the destinations once all of them
+// are complete, so haproxy never sees a partially written config. A failed
+// render, or a config the checker rejects, leaves all current files in place.
+// It returns the backups of the replaced files keyed by destination.
+func writeHaproxyConfig(w *configWriter, data templateData) (map[string]string, error) {
 
-	haproxyConfigFile, err := os.Create(haproxyFileDest)
+	var rendered []string
+	defer func() {
+		// a no-op for the files that were renamed
+		for _, name := range rendered {
+			os.Remove(name)
+		}
+	}()
+	unchanged := !w.force && !w.reloadPending
+	for i, t := range haProxyTemplates {
+		name, err := renderTemplate(w, t, data, w.header && i == 0)
+		if err != nil {
+			return nil, err
+		}
+		rendered = append(rendered, name)
+		unchanged = unchanged && sameContent(name, t.dest)
+	}
+	if unchanged {
+		return nil, errConfigUnchanged
+	}
+
+	err := w.checker.check(rendered[0])
+	if err != nil {
+		log.Println("keeping the current config: ", err)
+		return nil, permanentError{err}
+	}
+	err = w.hooks.beforeWrite(newReloadContext(data))
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make(map[string]string)
+	for _, t := range haProxyTemplates {
+		backups[t.dest], err = backupConfig(t.dest, w.backupCount)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, t := range haProxyTemplates {
+		err = os.Rename(rendered[i], t.dest)
+		if err != nil {
+			log.Println("error when replacing config file: ", err)
+			return nil, err
+		}
+	}
+	log.Println("config template populated with: ", data)
+
+	return backups, nil
+}
+
+// sameContent reports whether both files exist and are identical apart from
+// the provenance header.
+func sameContent(a, b string) bool {
+	contentA, err := ioutil.ReadFile(a)
+	if err != nil {
+		return false
+	}
+	contentB, err := ioutil.ReadFile(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(stripHeader(contentA), stripHeader(contentB))
+}
+
+// renderTemplate renders the template into a temporary file next to its
+// destination and returns the name of that file.
+func renderTemplate(w *configWriter, t *configTemplate, data templateData, header bool) (string, error) {
+	var body bytes.Buffer
+	err := t.Execute(&body, templateRoot(data, w.legacyRoot))
+	if err != nil {
+		log.Printf("error when rendering %v: %v\n", t.dest, err)
+		return "", permanentError{err}
+	}
+
+	haproxyConfigFile, err := ioutil.TempFile(filepath.Dir(t.dest), "."+filepath.Base(t.dest)+".")
 	if err != nil {
 		log.Println("error when creating config file: ", err)
-		return err
+		return "", err
+	}
+
+	if header {
+		_, err = haproxyConfigFile.Write(provenanceHeader(data, body.Bytes()))
+	}
+	if err == nil {
+		_, err = haproxyConfigFile.Write(body.Bytes())
+	}
+	if err == nil {
+		err = w.ownership.apply(haproxyConfigFile, t.dest)
+	}
+	if err == nil {
+		err = haproxyConfigFile.Sync()
+	}
+	closeErr := haproxyConfigFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(haproxyConfigFile.Name())
+		log.Printf("error when writing %v: %v\n", t.dest, err)
+		return "", err
+	}
+	return haproxyConfigFile.Name(), nil
+}
+
+// configFileMode keeps the permissions of an existing config file, a new
+// one is made readable by everyone like os.Create would. Once secrets are
+// loaded other users lose access, the config may contain them.
+func configFileMode(haproxyFileDest string) os.FileMode {
+	mode := os.FileMode(0644)
+	info, err := os.Stat(haproxyFileDest)
+	if err == nil {
+		mode = info.Mode().Perm()
+	}
+	if len(currentSecrets()) > 0 {
+		mode &^= 0007
+	}
+	return mode
+}
+
+// handleMessage regenerates the config for a notification. An error is
+// returned when the instances couldn't be discovered or the config couldn't
+// be written, in which case the message is left on the queue to be retried.
+// With debouncing enabled the regeneration happens later and the message is
+// always considered handled.
+func (u *configUpdater) handleMessage(msg *sqs.Message) error {
+	environ := u.environ
+
+	var msgBody *snsMsg
+	var ok bool
+	if isRawMsg(msg, u.rawDelivery) {
+		if !environ.trustRawMsg(u.rawDelivery, aws.StringValue(msg.Body)) {
+			log.Printf("warning: unsigned raw msg dropped, set SQS_RAW_DELIVERY=true to accept it: %#v", msg)
+			return nil
+		}
+		msgBody, ok = newRawMsg(msg)
+	} else {
+		if !environ.AwsSnsSkipSignatureVerification {
+			err := verifySNSSignature([]byte(*msg.Body))
+			if err != nil {
+				log.Printf("msg signature invalid: %v: %#v", err, msg)
+				return nil
+			}
+		}
+		msgBody, ok = validateMsg(msg, environ)
+	}
+	if !ok {
+		log.Printf("msg invalid: %#v", msg)
+		return nil
+	}
+
+	switch msgBody.Type {
+	case "SubscriptionConfirmation":
+		err := confirmSubscription(msgBody.SubscribeURL)
+		if err != nil {
+			log.Println("error when confirming subscription: ", err)
+			return nil
+		}
+		log.Println("confirmed subscription to topic: ", msgBody.TopicArn)
+		return nil
+	case "UnsubscribeConfirmation":
+		log.Println("ignoring unsubscribe confirmation for topic: ", msgBody.TopicArn)
+		return nil
+	}
+
+	if environ.isStale(msgBody, time.Now()) {
+		return errStaleMessage
+	}
+
+	if !environ.isEventHandled(msgBody.Message) {
+		log.Println("ignoring msg with unhandled event: ", msgBody.Subject)
+		return nil
+	}
+
+	messageID := dedupID(msg, msgBody)
+	if u.deduper.isDuplicate(messageID, time.Now()) {
+		return nil
 	}
 
-	err = haProxyTemplate.Execute(haproxyConfigFile, templateData)
+	u.addTrigger(messageID + " " + messageEvent(msgBody))
+	spot, err := u.handleSpotInterruption(msgBody)
 	if err != nil {
-		log.Println("error when writing to file: ", err)
 		return err
 	}
-	log.Println("config template populated with: ", templateData)
+	if !spot {
+		if notification, ok := parseNotification(msgBody.Message); ok &&
+			notification.Event == eventInstanceTerminate && u.writer.runtime != nil {
+			u.drainInstance(notification.EC2InstanceId)
+		}
+		applied := u.applyNotification(msgBody)
+		if lifecycle, ok := parseLifecycleNotification(msgBody.Message); ok {
+			// the hook waits for the reload, so don't debounce it. The
+			// action is completed by the update that removes the instance,
+			// which is a later one when this one is deferred.
+			u.waitForRemoval(lifecycle)
+			err = u.update(!applied)
+		} else {
+			err = u.requestUpdate(!applied)
+		}
+		if err != nil {
+			return err
+		}
+	}
 
+	u.deduper.add(messageID, time.Now())
 	return nil
 }
 
-func handleMessage(ec2Client *ec2.EC2, msg *sqs.Message, environ *env) {
+// writeSideFiles writes the optional files derived from the same data as the
+// config, once the config itself is written. Failures don't fail the update.
+// History isn't one of them, it's only recorded when a config was installed.
+func writeSideFiles(w *configWriter, environ *env, data templateData) {
+	if environ.BackendsJSONDest != "" {
+		err := writeBackendsJSON(w, environ.BackendsJSONDest, data)
+		if err != nil {
+			log.Println("error when writing backends json: ", err)
+		}
+	}
+	if environ.HaproxyStateFileDest != "" {
+		err := writeServerStateFile(w, environ.HaproxyStateFileDest, data)
+		if err != nil {
+			log.Println("error when writing server state file: ", err)
+		}
+	}
+}
 
-	if !validateMsg(msg) {
-		log.Printf("msg invalid: %#v", msg)
-		return
+// applyConfig writes the haproxy config and reloads haproxy. When the reload
+// fails the previous config is restored and reloaded, and an error is
+// returned either way. With DATAPLANE_URL set the servers are reconciled
+// through the Data Plane API instead. reloaded reports whether haproxy was
+// reloaded or updated at runtime, which isn't the case when nothing changed
+// or reloads are disabled.
+func applyConfig(w *configWriter, opts *discoveryOptions, groupNames []string, config map[string][]templateItem, environ *env, trigger string) (reloaded bool, err error) {
+	data := newTemplateData(opts, groupNames, config)
+	err = checkBackends(data, environ)
+	if err != nil {
+		return false, rejectUpdate(err)
 	}
 
-	templateData, err := getEC2Config(ec2Client, environ.AwsEC2GroupName)
+	unlock, err := w.lock.acquire()
 	if err != nil {
-		return
+		return false, err
 	}
+	defer unlock()
 
-	err = writeHaproxyConfig(environ.HaproxyFileDest, templateData)
+	if w.dataPlane != nil {
+		return w.dataPlane.apply(data)
+	}
+	certsChanged, err := w.certs.install()
 	if err != nil {
-		return
+		log.Println("keeping the current config: ", err)
+		return false, err
+	}
+	if certsChanged {
+		w.reloadPending = true
+		w.reloadRequired = true
+	}
+	if w.hostMap != nil {
+		return applyMap(w, environ, data)
 	}
+	data.Trigger = trigger
+	backups, err := writeHaproxyConfig(w, data)
+	if err == errConfigUnchanged {
+		log.Println("no change, skipping reload")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	writeSideFiles(w, environ, data)
+	recordHistory(environ, haProxyTemplates[0].dest, data.GeneratedAt)
 
-	reloadHaproxy(environ.HaproxyReloadScript)
+	rc := newReloadContext(data)
+	reloaded, err = reloadLocal(w, environ, data, backups, rc)
+	if err != nil {
+		// the remote hosts and the fleet keep their config, it was rolled
+		// back here
+		return false, err
+	}
+	remoteErr := w.remotes.distribute(rc)
+	fleetErr := w.fleet.update(rc)
+	for _, err := range []error{remoteErr, fleetErr} {
+		if err != nil {
+			// push the config again with the next update
+			w.reloadPending = true
+			return reloaded, err
+		}
+	}
+	return reloaded, nil
 }
 
-func getInstanceListFromGroup(ec2Client *ec2.EC2, groupName string) ([]*internalInstance, error) {
+// reloadLocal applies the written config to the local haproxy, at runtime
+// when that's possible and by reloading it otherwise. It reports whether
+// either happened.
+func reloadLocal(w *configWriter, environ *env, data templateData, backups map[string]string, rc reloadContext) (bool, error) {
+	if environ.reloadDisabled() {
+		log.Println("config updated, reload skipped by configuration")
+		return false, nil
+	}
+	if w.runtime != nil && !w.reloadRequired {
+		err := applyRuntime(w.runtime, data)
+		if err == nil {
+			return true, nil
+		}
+		log.Println("falling back to reloading haproxy")
+	}
+
+	if w.runtime != nil && environ.HaproxyDrainWaitSeconds > 0 {
+		waitForRemovedServers(w.runtime, data, environ)
+	}
+	err := reloadWithRetries(w, environ, rc)
+	if err == errReloadSuperseded {
+		w.reloadPending = true
+		return false, err
+	}
+	if err != nil {
+		return false, rollbackConfig(w, backups, environ, err, rc)
+	}
+	w.reloadPending = false
+	w.reloadRequired = false
+	w.hooks.afterReload(rc)
+	return true, nil
+}
+
+// describeInstances fetches all pages of a DescribeInstances call and returns
+// the aggregated reservations.
+func describeInstances(rc *regionClient, opts *discoveryOptions, input *ec2.DescribeInstancesInput, groupName string) ([]*ec2.Reservation, error) {
+
+	var reservations []*ec2.Reservation
+
+	pages := 0
+	err := retryOnThrottling(opts.maxRetries, opts.retryTimeout, func() error {
+		reservations = nil
+		pages = 0
+		return rc.ec2Client.DescribeInstancesPages(input, func(output *ec2.DescribeInstancesOutput, lastPage bool) bool {
+			pages++
+			reservations = append(reservations, output.Reservations...)
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("fetched %d page(s) of instances for group %v in %v\n", pages, groupName, rc.region)
+
+	return reservations, nil
+}
+
+// isInstanceActive double checks the instance state against the states
+// requested in the instance-state-name filter.
+func (o *discoveryOptions) isInstanceActive(instance *ec2.Instance) bool {
+	if instance.State == nil {
+		return false
+	}
+	for _, state := range o.instanceStates {
+		if aws.StringValue(instance.State.Name) == state {
+			return true
+		}
+	}
+	return false
+}
+
+func isInstanceServing(state string) bool {
+	return state == ec2.InstanceStateNameRunning || state == ec2.InstanceStateNamePending
+}
+
+func firstIPv6Address(instance *ec2.Instance) string {
+	for _, networkInterface := range instance.NetworkInterfaces {
+		for _, address := range networkInterface.Ipv6Addresses {
+			if aws.StringValue(address.Ipv6Address) != "" {
+				return *address.Ipv6Address
+			}
+		}
+	}
+	return ""
+}
+
+func newInternalInstance(instance *ec2.Instance, region string) *internalInstance {
+	instanceObj := &internalInstance{tags: make(map[string]string)}
+
+	instanceObj.region = region
+	instanceObj.instanceID = aws.StringValue(instance.InstanceId)
+	instanceObj.instanceType = aws.StringValue(instance.InstanceType)
+	instanceObj.internalDNS = aws.StringValue(instance.PrivateDnsName)
+	instanceObj.internalIP = aws.StringValue(instance.PrivateIpAddress)
+	instanceObj.publicDNS = aws.StringValue(instance.PublicDnsName)
+	instanceObj.publicIP = aws.StringValue(instance.PublicIpAddress)
+	instanceObj.ipv6 = firstIPv6Address(instance)
+	if instance.LaunchTime != nil {
+		instanceObj.launchTime = *instance.LaunchTime
+	}
+	if instance.State != nil {
+		instanceObj.state = aws.StringValue(instance.State.Name)
+	}
+	if instance.Placement != nil {
+		instanceObj.availabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+	}
+
+	for _, tag := range instance.Tags {
+		instanceObj.tags[*tag.Key] = *tag.Value
+		if *tag.Key == "Name" {
+			instanceObj.name = *tag.Value
+		}
+	}
+
+	return instanceObj
+}
+
+// getInstanceListFromGroup returns the active instances tagged with the group.
+// When instanceIDs is set only those instances are described.
+func getInstanceListFromGroup(rc *regionClient, opts *discoveryOptions, groupName string, instanceIDs []*string) ([]*internalInstance, error) {
 
 	var instances []*internalInstance
 
-	output, err := ec2Client.DescribeInstances(&ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{
-			{
-				Name:   aws.String("tag:group"),
-				Values: []*string{aws.String(groupName)},
-			},
+	filters := []*ec2.Filter{
+		{
+			Name:   aws.String("tag:" + opts.groupTagKey),
+			Values: []*string{aws.String(groupName)},
 		},
-	})
+	}
+	filters = append(filters, opts.extraTagFilters...)
+	filters = append(filters, opts.instanceFilters()...)
+
+	reservations, err := describeInstances(rc, opts, &ec2.DescribeInstancesInput{
+		Filters:     filters,
+		InstanceIds: instanceIDs,
+	}, groupName)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, reservation := range output.Reservations {
+	for _, reservation := range reservations {
 		for _, instance := range reservation.Instances {
 			instanceIsRelevant := false
-			instanceObj := &internalInstance{}
-
-			instanceObj.instanceID = *instance.InstanceId
-			instanceObj.instanceType = *instance.InstanceType
 
 			for _, tag := range instance.Tags {
-				if *tag.Key == "group" && *tag.Value == groupName {
+				if *tag.Key == opts.groupTagKey && *tag.Value == groupName {
 					instanceIsRelevant = true
 				}
-				if *tag.Key == "Name" {
-					instanceObj.name = *tag.Value
-				}
 			}
-			if instanceIsRelevant &&
-				(*instance.State.Name == ec2.InstanceStateNameRunning ||
-					*instance.State.Name == ec2.InstanceStateNamePending) {
-
-				instanceObj.internalDNS = *instance.PrivateDnsName
-				instanceObj.internalIP = *instance.PrivateIpAddress
+			if instanceIsRelevant && opts.isInstanceActive(instance) && opts.inNetwork(instance) {
+				instanceObj := newInternalInstance(instance, rc.region)
 
 				log.Println("found instance: ", *instanceObj)
 				instances = append(instances, instanceObj)
@@ -199,10 +1716,14 @@ func getInstanceListFromGroup(ec2Client *ec2.EC2, groupName string) ([]*internal
 	return instances, nil
 }
 
-func getQueueURL(sqsClient *sqs.SQS, awsSqsQueueName string) (*string, error) {
-	queueURLObj, err := sqsClient.GetQueueUrl(&sqs.GetQueueUrlInput{
+func getQueueURL(sqsClient *sqs.SQS, awsSqsQueueName string, ownerAccountID string) (*string, error) {
+	input := &sqs.GetQueueUrlInput{
 		QueueName: aws.String(awsSqsQueueName),
-	})
+	}
+	if ownerAccountID != "" {
+		input.QueueOwnerAWSAccountId = aws.String(ownerAccountID)
+	}
+	queueURLObj, err := sqsClient.GetQueueUrl(input)
 	if err != nil {
 		return nil, err
 	}
@@ -222,49 +1743,313 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	err = environ.validateReload()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	renderPairs, err := environ.renderPairs()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	// establish session and get client
-	session := session.New(&aws.Config{
-		Credentials: credentials.NewEnvCredentials(),
-		Region:      aws.String(environ.AwsSqsRegion),
-	})
+	session, err := newSession(environ)
+	if err != nil {
+		log.Println("error when creating AWS session")
+		log.Fatalln(err)
+	}
+
+	ssmClient := ssm.New(session)
+	err = loadSecrets(environ, ssmClient)
+	if err != nil {
+		log.Println("error when loading template secrets: ", err)
+		log.Fatalln(err)
+	}
+	haProxyTemplates, err = loadTemplates(renderPairs, templateFuncs(environ), environ.HaproxyTemplateStrict, s3.New(session))
+	if err != nil {
+		log.Println("error when loading template: ", err)
+		log.Fatalln(err)
+	}
+	if !environ.HaproxyTemplateSkipSelfTest {
+		err = selfTestTemplates(environ)
+		if err != nil {
+			log.Println("set HAPROXY_TEMPLATE_SKIP_SELF_TEST to skip the self-test")
+			log.Fatalln(err)
+		}
+	}
 	sqsClient := sqs.New(session)
-	ec2Client := ec2.New(session)
+	ec2Session, err := newEC2Session(session, environ.AwsEC2AssumeRoleArn, environ.AwsEC2AssumeRoleExternalID)
+	if err != nil {
+		log.Println("error when assuming role: ", environ.AwsEC2AssumeRoleArn)
+		log.Fatalln(err)
+	}
+	regionClients := newRegionClients(ec2Session, environ.regions())
+
+	if environ.AwsAutoScalingGroupName != "" &&
+		(environ.AwsEC2GroupName != "" || environ.AwsEC2GroupNames != "") {
+		log.Println("warning: AWS_AUTOSCALING_GROUP_NAME is set, ignoring EC2 group names")
+	}
 
-	queueURL, err := getQueueURL(sqsClient, environ.AwsSqsQueueName)
+	groupNames := environ.discoveryGroups()
+	if len(environ.groupNames()) == 0 {
+		log.Fatalln("no group configured, set AWS_EC2_GROUP_NAMES, AWS_EC2_GROUP_NAME or AWS_AUTOSCALING_GROUP_NAME")
+	}
+
+	opts, err := newDiscoveryOptions(environ)
 	if err != nil {
-		log.Println("no queue found: ", environ.AwsSqsQueueName)
 		log.Fatalln(err)
 	}
 
+	if opts.localAZ == localAZAuto {
+		opts.localAZ, err = ec2metadata.New(session).GetMetadata("placement/availability-zone")
+		if err != nil {
+			log.Println("error when detecting the local availability zone")
+			log.Fatalln(err)
+		}
+		log.Println("detected local availability zone: ", opts.localAZ)
+	}
+	if opts.peersGroupName != "" {
+		opts.localInstanceID, err = ec2metadata.New(session).GetMetadata("instance-id")
+		if err != nil {
+			log.Println("warning: can't tell the local peer, error when getting the instance ID: ", err)
+		}
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		err = generate(regionClients, opts, groupNames, environ)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	queueNames := environ.queueNames()
+	if environ.SqsQueuePerHost {
+		queueName, err := environ.hostQueueName(ec2metadata.New(session))
+		if err != nil {
+			log.Println("error when naming the queue of this host")
+			log.Fatalln(err)
+		}
+		queueNames = []string{queueName}
+	}
+
+	queueURLs := make(map[string]*string)
+	subscriptionArns := make(map[string]string)
+	if environ.AwsSqsQueueURL != "" {
+		queueName := queueNameFromURL(environ.AwsSqsQueueURL)
+		queueNames = nil
+		queueURLs[queueName] = aws.String(environ.AwsSqsQueueURL)
+	}
+	for _, queueName := range queueNames {
+		if environ.Bootstrap || environ.SqsQueuePerHost {
+			queueURLs[queueName], subscriptionArns[queueName], err = bootstrapQueue(sqsClient, sns.New(session), queueName, environ)
+			if err != nil {
+				log.Println("bootstrap failed for queue: ", queueName)
+				log.Fatalln(err)
+			}
+		} else {
+			queueURLs[queueName], err = getQueueURL(sqsClient, queueName, environ.AwsSqsQueueOwnerAccountID)
+			if err != nil {
+				log.Println("no queue found: ", queueName)
+				log.Fatalln(queueURLError(queueName, environ.AwsSqsQueueOwnerAccountID, err))
+			}
+		}
+		if isFIFOQueue(queueName) && !strings.HasSuffix(aws.StringValue(queueURLs[queueName]), "/"+queueName) {
+			log.Fatalln("queue url does not match FIFO queue name: ", aws.StringValue(queueURLs[queueName]))
+		}
+	}
+
 	log.Println("write to config on start")
-	templateData, err := getEC2Config(ec2Client, environ.AwsEC2GroupName)
+	config, err := getEC2ConfigWaitingForAddresses(regionClients, opts, groupNames)
 	if err != nil {
 		log.Println("error when trying to fetch ec2 config on start")
 		log.Fatalln(err)
 	}
-	err = writeHaproxyConfig(environ.HaproxyFileDest, templateData)
+	writer, err := newConfigWriter(environ)
 	if err != nil {
-		log.Println("error when trying to write to config file on the start")
 		log.Fatalln(err)
 	}
-
-	log.Println("consume from queue:", *queueURL)
-	for {
-		resp, err := sqsClient.ReceiveMessage(&sqs.ReceiveMessageInput{
-			QueueUrl:        queueURL,
-			WaitTimeSeconds: aws.Int64(defaultWaitTimeSeconds),
-		})
+	writer.fleet, err = newSSMFleet(environ, session)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	writer.certs, err = newCertInstaller(environ, s3.New(session), writer.ownership)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	data := newTemplateData(opts, groupNames, config)
+	err = checkBackends(data, environ)
+	if err != nil {
+		rejectUpdate(err)
+		// nothing was applied, so the first update isn't skipped
+		config = nil
+	} else {
+		data.Trigger = "startup"
+		unlock, err := writer.lock.acquire()
 		if err != nil {
-			fmt.Println("error when recieving message", err)
-			continue
+			log.Fatalln(err)
+		}
+		installed := false
+		if writer.dataPlane != nil {
+			_, err = writer.dataPlane.apply(data)
+		} else if writer.hostMap != nil {
+			_, err = applyMap(writer, environ, data)
+		} else {
+			_, err = writer.certs.install()
+			if err == nil {
+				_, err = writeHaproxyConfig(writer, data)
+				installed = err == nil
+			}
+		}
+		unlock()
+		if err == errConfigUnchanged {
+			log.Println("config on disk is up to date")
+		} else if err != nil {
+			log.Println("error when trying to write to config file on the start")
+			log.Fatalln(err)
 		}
+		writeSideFiles(writer, environ, data)
+		if installed {
+			recordHistory(environ, haProxyTemplates[0].dest, data.GeneratedAt)
+		}
+	}
 
-		for _, msg := range resp.Messages {
-			handleMessage(ec2Client, msg, environ)
-			sqsClient.DeleteMessage(&sqs.DeleteMessageInput{
-				QueueUrl:      queueURL,
-				ReceiptHandle: msg.ReceiptHandle,
-			})
+	receiveOpts, err := newReceiveOptions(environ)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	poison, err := newPoisonHandler(sqsClient, environ)
+	if err != nil {
+		log.Println("no dead-letter queue found: ", environ.AwsSqsDeadLetterQueueName)
+		log.Fatalln(err)
+	}
+
+	rawDelivery, err := environ.rawDeliveryMode()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if rawDelivery == rawDeliveryAuto && environ.eventBridgeAccountID() == "" && !environ.AwsSnsSkipSignatureVerification {
+		log.Println("warning: no AWS_EVENTBRIDGE_ACCOUNT_ID set, EventBridge events sent straight to the queue are dropped")
+	}
+
+	updater := newConfigUpdater(regionClients, opts, environ)
+	updater.writer = writer
+	updater.targetGroup, err = newTargetGroup(environ, ec2Session)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	writer.superseded = updater.superseded
+	updater.rawDelivery = rawDelivery
+	updater.lastConfig = config
+	updater.maxRemoval, err = environ.maxRemovalFraction()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	updater.canary, err = newCanaryCheck(environ)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if updater.debounce.enabled() {
+		go updater.debounce.loop()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if environ.SyncIntervalSeconds > 0 {
+		log.Printf("syncing config every %d seconds\n", environ.SyncIntervalSeconds)
+		go updater.syncLoop(ctx, time.Duration(environ.SyncIntervalSeconds)*time.Second)
+	}
+	if environ.HaproxyTemplatePollSeconds > 0 {
+		log.Printf("checking templates for changes every %d seconds\n", environ.HaproxyTemplatePollSeconds)
+		go updater.templateLoop(ctx, time.Duration(environ.HaproxyTemplatePollSeconds)*time.Second)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Println("shutting down on signal: ", sig)
+		cancel()
+	}()
+
+	forces := make(chan os.Signal, 1)
+	signal.Notify(forces, syscall.SIGUSR1)
+	go func() {
+		for range forces {
+			log.Println("forcing an update on SIGUSR1")
+			err := updater.force()
+			if err != nil {
+				log.Println("error when forcing update: ", err)
+			}
+		}
+	}()
+
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			err := loadSecrets(environ, ssmClient)
+			if err != nil {
+				log.Println("error when reloading template secrets, keeping the current ones: ", err)
+			}
+			_, err = reloadTemplates()
+			if err != nil {
+				log.Println("error when re-parsing template, keeping the current one: ", err)
+				continue
+			}
+			log.Println("re-parsed template, re-rendering config")
+			err = updater.rerender()
+			if err != nil {
+				log.Println("error when re-rendering config: ", err)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for queueName, queueURL := range queueURLs {
+		consumer := &queueConsumer{
+			sqsClient:   sqsClient,
+			queueName:   queueName,
+			queueURL:    queueURL,
+			fifo:        isFIFOQueue(queueName),
+			receiveOpts: receiveOpts,
+			batchSize:   environ.batchSize(),
+			maxFailures: environ.maxReceiveFailures(),
+			maxDrain:    environ.maxDrain(),
+			poison:      poison,
+			updater:     updater,
 		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			consumer.poll(ctx)
+		}()
+	}
+
+	<-ctx.Done()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		// wait for an update started by the debouncer
+		updater.mu.Lock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		if environ.SqsQueuePerHost {
+			for queueName, queueURL := range queueURLs {
+				deleteHostQueue(sqsClient, sns.New(session), queueURL, subscriptionArns[queueName])
+			}
+		}
+		log.Println("shutdown complete")
+	case <-time.After(environ.shutdownTimeout()):
+		log.Fatalln("shutdown did not complete in time")
+	}
+}
+
+// shutdownTimeout returns how long in-flight work may take on shutdown.
+func (e *env) shutdownTimeout() time.Duration {
+	if e.ShutdownTimeoutSeconds > 0 {
+		return time.Duration(e.ShutdownTimeoutSeconds) * time.Second
 	}
+	return defaultShutdownTimeout
 }
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const testAutoScalingEvent = `{"Event":"autoscaling:EC2_INSTANCE_LAUNCH","AutoScalingGroupName":"web","EC2InstanceId":"i-0123456789abcdef0"}`
+
+func testSQSMessage(body string) *sqs.Message {
+	return &sqs.Message{
+		Body:      aws.String(body),
+		MessageId: aws.String("sqs-message-id"),
+	}
+}
+
+func TestRawDeliveryMode(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"", "false", false},
+		{"true", "true", false},
+		{"false", "false", false},
+		{"auto", "auto", false},
+		{"yes", "", true},
+	}
+	for _, tt := range tests {
+		environ := &env{SqsRawDelivery: tt.value}
+		got, err := environ.rawDeliveryMode()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("rawDeliveryMode(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("rawDeliveryMode(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestIsRawMsg(t *testing.T) {
+	envelope := `{"Type":"Notification","MessageId":"m-1","TopicArn":"arn:aws:sns:us-east-1:123456789012:asg",` +
+		`"Message":` + `"{\"Event\":\"autoscaling:EC2_INSTANCE_LAUNCH\"}"}`
+	tests := []struct {
+		name string
+		body string
+		mode string
+		want bool
+	}{
+		{"envelope auto", envelope, "auto", false},
+		{"raw auto", testAutoScalingEvent, "auto", true},
+		{"envelope missing topic auto", `{"Type":"Notification","MessageId":"m-1"}`, "auto", true},
+		{"invalid json auto", `not json`, "auto", true},
+		{"raw forced envelope", testAutoScalingEvent, "false", false},
+		{"envelope forced raw", envelope, "true", true},
+	}
+	for _, tt := range tests {
+		if got := isRawMsg(testSQSMessage(tt.body), tt.mode); got != tt.want {
+			t.Errorf("%v: isRawMsg() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTrustRawMsg(t *testing.T) {
+	tests := []struct {
+		mode string
+		skip bool
+		want bool
+	}{
+		{"true", false, true},
+		{"auto", false, false},
+		{"false", false, false},
+		{"auto", true, true},
+	}
+	for _, tt := range tests {
+		environ := &env{AwsSnsSkipSignatureVerification: tt.skip}
+		if got := environ.trustRawMsg(tt.mode, `{"Event": "autoscaling:EC2_INSTANCE_LAUNCH"}`); got != tt.want {
+			t.Errorf("trustRawMsg(%q) with skip verification %v = %v, want %v", tt.mode, tt.skip, got, tt.want)
+		}
+	}
+}
+
+func TestRawAndEnvelopeBodies(t *testing.T) {
+	environ := &env{AwsSnsTopicArn: "arn:aws:sns:us-east-1:123456789012:asg"}
+	envelope := `{"Type":"Notification","MessageId":"m-1","TopicArn":"arn:aws:sns:us-east-1:123456789012:asg",` +
+		`"Message":"{\"Event\":\"autoscaling:EC2_INSTANCE_LAUNCH\",\"AutoScalingGroupName\":\"web\",` +
+		`\"EC2InstanceId\":\"i-0123456789abcdef0\"}"}`
+
+	fromEnvelope, ok := validateMsg(testSQSMessage(envelope), environ)
+	if !ok {
+		t.Fatal("validateMsg() rejected a valid envelope")
+	}
+	fromRaw, ok := newRawMsg(testSQSMessage(testAutoScalingEvent))
+	if !ok {
+		t.Fatal("newRawMsg() rejected a valid raw payload")
+	}
+	if fromRaw.MessageID != "sqs-message-id" {
+		t.Errorf("raw msg MessageID = %q, want the SQS message id", fromRaw.MessageID)
+	}
+
+	for name, msgBody := range map[string]*snsMsg{"envelope": fromEnvelope, "raw": fromRaw} {
+		notification, ok := parseNotification(msgBody.Message)
+		if !ok {
+			t.Errorf("%v: parseNotification() failed for %q", name, msgBody.Message)
+			continue
+		}
+		if notification.Event != eventInstanceLaunch || notification.EC2InstanceId != "i-0123456789abcdef0" {
+			t.Errorf("%v: parseNotification() = %+v", name, notification)
+		}
+	}
+
+	if _, ok := newRawMsg(testSQSMessage("not json")); ok {
+		t.Error("newRawMsg() accepted a body that isn't json")
+	}
+}
+
+func TestReloadArgsQuoting(t *testing.T) {
+	tests := []struct {
+		command    string
+		configPath string
+		want       string
+	}{
+		{`printf '%s' "$1"`, "/etc/haproxy/haproxy.cfg", "/etc/haproxy/haproxy.cfg"},
+		{`printf '%s' "$1"`, "/etc/ha proxy/haproxy new.cfg", "/etc/ha proxy/haproxy new.cfg"},
+		{`printf '%s' "$1"`, `/tmp/it's "quoted" $HOME.cfg`, `/tmp/it's "quoted" $HOME.cfg`},
+		{`printf '%s|' "arg with spaces" "$1"`, "/tmp/a b.cfg", "arg with spaces|/tmp/a b.cfg|"},
+		{`printf '%s|' $1`, "/tmp/a b.cfg", "/tmp/a|b.cfg|"},
+		{`test -n "$HOME" && printf '%s' "$#"`, "/tmp/haproxy.cfg", "1"},
+	}
+	for _, tt := range tests {
+		environ := &env{HaproxyReloadCommand: tt.command}
+		args := environ.reloadArgs(tt.configPath)
+		out, err := exec.Command(args[0], args[1:]...).Output()
+		if err != nil {
+			t.Errorf("reload command %q failed: %v", tt.command, err)
+			continue
+		}
+		if string(out) != tt.want {
+			t.Errorf("reload command %q with %q printed %q, want %q", tt.command, tt.configPath, out, tt.want)
+		}
+	}
+}
+
+func TestReloadArgsScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "reload haproxy.sh")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nprintf '%s' \"$1\"\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	environ := &env{HaproxyReloadScript: script}
+	args := environ.reloadArgs("/etc/ha proxy/haproxy.cfg")
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "/etc/ha proxy/haproxy.cfg" {
+		t.Errorf("reload script printed %q", out)
+	}
+}
+
+func TestValidateReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		environ *env
+		wantErr bool
+	}{
+		{"script", &env{HaproxyReloadScript: "/reload.sh"}, false},
+		{"command", &env{HaproxyReloadCommand: "systemctl reload haproxy"}, false},
+		{"script and command", &env{HaproxyReloadScript: "/reload.sh", HaproxyReloadCommand: "systemctl reload haproxy"}, true},
+		{"master without socket", &env{HaproxyReloadMode: reloadModeMaster}, true},
+		{"unknown mode", &env{HaproxyReloadMode: "signal"}, true},
+		{"invalid ok codes", &env{HaproxyReloadScript: "/reload.sh", HaproxyReloadOKCodes: "0,x"}, true},
+	}
+	for _, tt := range tests {
+		err := tt.environ.validateReload()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: validateReload() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// fakeEC2 serves DescribeInstancesPages from pages, failing the first
+// throttled calls with a throttling error.
+type fakeEC2 struct {
+	ec2iface.EC2API
+	pages     []*ec2.DescribeInstancesOutput
+	throttled int
+	calls     int
+	statuses  []*ec2.InstanceStatus
+}
+
+func (f *fakeEC2) DescribeInstanceStatus(input *ec2.DescribeInstanceStatusInput) (*ec2.DescribeInstanceStatusOutput, error) {
+	return &ec2.DescribeInstanceStatusOutput{InstanceStatuses: f.statuses}, nil
+}
+
+func (f *fakeEC2) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	f.calls++
+	for i, page := range f.pages {
+		if f.calls <= f.throttled && i == 1 {
+			return awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)
+		}
+		if !fn(page, i == len(f.pages)-1) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func testReservation(instanceIDs ...string) *ec2.Reservation {
+	reservation := &ec2.Reservation{}
+	for _, instanceID := range instanceIDs {
+		reservation.Instances = append(reservation.Instances, &ec2.Instance{InstanceId: aws.String(instanceID)})
+	}
+	return reservation
+}
+
+func TestDescribeInstancesPages(t *testing.T) {
+	pages := []*ec2.DescribeInstancesOutput{
+		{Reservations: []*ec2.Reservation{testReservation("i-1", "i-2")}, NextToken: aws.String("page-2")},
+		{Reservations: []*ec2.Reservation{testReservation("i-3"), testReservation("i-4")}, NextToken: aws.String("page-3")},
+		{Reservations: []*ec2.Reservation{testReservation("i-5")}},
+	}
+	for _, throttled := range []int{0, 2} {
+		fake := &fakeEC2{pages: pages, throttled: throttled}
+		rc := &regionClient{region: "us-east-1", ec2Client: fake}
+		opts := &discoveryOptions{maxRetries: 3, retryTimeout: time.Minute}
+		reservations, err := describeInstances(rc, opts, &ec2.DescribeInstancesInput{}, "web")
+		if err != nil {
+			t.Fatalf("describeInstances() error = %v", err)
+		}
+		var instanceIDs []string
+		for _, reservation := range reservations {
+			for _, instance := range reservation.Instances {
+				instanceIDs = append(instanceIDs, aws.StringValue(instance.InstanceId))
+			}
+		}
+		// a retry starts over instead of keeping the pages fetched before
+		want := []string{"i-1", "i-2", "i-3", "i-4", "i-5"}
+		if !reflect.DeepEqual(instanceIDs, want) {
+			t.Errorf("describeInstances() with %d throttled call(s) = %v, want %v", throttled, instanceIDs, want)
+		}
+		if fake.calls != throttled+1 {
+			t.Errorf("describeInstances() made %d call(s), want %d", fake.calls, throttled+1)
+		}
+	}
+}
+
+func TestDescribeInstancesError(t *testing.T) {
+	pages := []*ec2.DescribeInstancesOutput{
+		{Reservations: []*ec2.Reservation{testReservation("i-1")}, NextToken: aws.String("page-2")},
+		{Reservations: []*ec2.Reservation{testReservation("i-2")}},
+	}
+	fake := &fakeEC2{pages: pages, throttled: 10}
+	rc := &regionClient{region: "us-east-1", ec2Client: fake}
+	opts := &discoveryOptions{maxRetries: 1, retryTimeout: time.Minute}
+	_, err := describeInstances(rc, opts, &ec2.DescribeInstancesInput{}, "web")
+	if err == nil {
+		t.Error("describeInstances() succeeded after running out of retries")
+	}
+}
+
+func testInstances() []*internalInstance {
+	var instances []*internalInstance
+	for i, name := range []string{"web-b", "web-a", "web-c", "web-a", "web-b"} {
+		ip := fmt.Sprintf("10.0.0.%d", i+1)
+		instances = append(instances, &internalInstance{
+			internalIP:   ip,
+			internalDNS:  "ip-" + strings.Replace(ip, ".", "-", -1) + ".ec2.internal",
+			state:        ec2.InstanceStateNameRunning,
+			instanceID:   fmt.Sprintf("i-%017d", i+1),
+			name:         name,
+			instanceType: "m5.large",
+			tags:         map[string]string{"Name": name},
+		})
+	}
+	return instances
+}
+
+func TestShuffledInstancesRenderIdentically(t *testing.T) {
+	opts, err := newDiscoveryOptions(&env{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, err := loadTemplates([]renderPair{{Template: "haproxy.cfg.template", Dest: "/dev/null"}},
+		templateFuncs(&env{}), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func(instances []*internalInstance) string {
+		config := newEC2Config(map[string][]*internalInstance{"web": instances}, opts, []string{"web"})
+		data := newTemplateData(opts, []string{"web"}, config)
+		data.GeneratedAt = time.Time{}
+		var out bytes.Buffer
+		err := templates[0].Execute(&out, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	instances := testInstances()
+	want := render(instances)
+	if strings.Count(want, "        server ") != len(instances) {
+		t.Fatalf("rendered config doesn't have every server:\n%v", want)
+	}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		shuffled := append([]*internalInstance(nil), instances...)
+		random.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		if got := render(shuffled); got != want {
+			t.Fatalf("shuffled instances rendered differently:\n%v\nwant\n%v", got, want)
+		}
+	}
+}
+
+func TestCountMissingAddress(t *testing.T) {
+	instances := []*internalInstance{
+		{instanceID: "i-private", internalIP: "10.0.0.1", internalDNS: "ip-10-0-0-1.ec2.internal"},
+		{instanceID: "i-public", publicIP: "203.0.113.1", publicDNS: "ec2-203-0-113-1.compute.amazonaws.com"},
+		{instanceID: "i-ipv6", ipv6: "2001:db8::1"},
+		{instanceID: "i-pending"},
+	}
+	tests := []struct {
+		endpointType string
+		want         int
+	}{
+		{endpointTypeIP, 3},
+		{endpointTypeDNS, 3},
+		{endpointTypePublicIP, 3},
+		{endpointTypePublicDNS, 3},
+		{endpointTypeIPv6, 3},
+		{endpointTypeIPv6First, 2},
+	}
+	for _, tt := range tests {
+		if got := countMissingAddress(instances, tt.endpointType); got != tt.want {
+			t.Errorf("countMissingAddress(%v) = %d, want %d", tt.endpointType, got, tt.want)
+		}
+	}
+}
+
+func TestGetWeight(t *testing.T) {
+	opts := &discoveryOptions{
+		weightTagKey:  defaultWeightTagKey,
+		defaultWeight: defaultWeight,
+		typeWeights:   map[string]int{"m5.xlarge": 4},
+	}
+	tests := []struct {
+		instanceType string
+		tag          string
+		want         int
+		wantSet      bool
+	}{
+		{"m5.large", "", defaultWeight, false},
+		{"m5.large", "20", 20, true},
+		{"m5.large", "0", 0, true},
+		{"m5.large", "300", defaultWeight, false},
+		{"m5.large", "heavy", defaultWeight, false},
+		{"m5.xlarge", "", 4, true},
+		{"m5.xlarge", "-1", 4, true},
+	}
+	for _, tt := range tests {
+		instance := &internalInstance{instanceID: "i-1", instanceType: tt.instanceType, tags: map[string]string{}}
+		if tt.tag != "" {
+			instance.tags[defaultWeightTagKey] = tt.tag
+		}
+		weight, set := instance.getWeight(opts)
+		if weight != tt.want || set != tt.wantSet {
+			t.Errorf("getWeight() for %v with tag %q = %d, %v, want %d, %v",
+				tt.instanceType, tt.tag, weight, set, tt.want, tt.wantSet)
+		}
+	}
+
+	opts.defaultWeightSet = true
+	if _, set := (&internalInstance{}).getWeight(opts); !set {
+		t.Error("getWeight() ignored HAPROXY_DEFAULT_WEIGHT")
+	}
+}
+
+func TestApplyLaunchNotificationChecksStatus(t *testing.T) {
+	launched := &ec2.Instance{
+		InstanceId:       aws.String("i-2"),
+		PrivateIpAddress: aws.String("10.0.0.2"),
+		State:            &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)},
+		Tags:             []*ec2.Tag{{Key: aws.String("group"), Value: aws.String("web")}},
+	}
+	fake := &fakeEC2{
+		pages: []*ec2.DescribeInstancesOutput{{Reservations: []*ec2.Reservation{{Instances: []*ec2.Instance{launched}}}}},
+		statuses: []*ec2.InstanceStatus{{
+			InstanceId:     aws.String("i-2"),
+			InstanceStatus: &ec2.InstanceStatusSummary{Status: aws.String(ec2.SummaryStatusImpaired)},
+		}},
+	}
+	for _, impairedDisable := range []bool{false, true} {
+		rc := &regionClient{
+			region:         "us-east-1",
+			ec2Client:      fake,
+			lastInstances:  map[string][]*internalInstance{"web": {{instanceID: "i-1", internalIP: "10.0.0.1", state: ec2.InstanceStateNameRunning}}},
+			missingAddress: make(map[string]int),
+		}
+		opts, err := newDiscoveryOptions(&env{
+			AwsEC2GroupTagKey:  "group",
+			AwsSkipImpaired:    true,
+			AwsImpairedDisable: impairedDisable,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgBody := &snsMsg{Message: `{"Event": "autoscaling:EC2_INSTANCE_LAUNCH", "EC2InstanceId": "i-2"}`}
+		if !applyNotification([]*regionClient{rc}, opts, []string{"web"}, msgBody) {
+			t.Fatal("applyNotification() fell back to a full discovery")
+		}
+
+		config := newEC2Config(cachedInstances([]*regionClient{rc}, []string{"web"}), opts, []string{"web"})
+		var servers []string
+		for _, item := range config["web"] {
+			servers = append(servers, fmt.Sprintf("%v disabled=%v", item.InstanceID, item.Disabled))
+		}
+		want := []string{"i-1 disabled=false"}
+		if impairedDisable {
+			want = append(want, "i-2 disabled=true")
+		}
+		if !reflect.DeepEqual(servers, want) {
+			t.Errorf("servers with impairedDisable=%v = %v, want %v", impairedDisable, servers, want)
+		}
+	}
+}
+
+func TestTrustEventBridgeMsg(t *testing.T) {
+	event := func(source, account, region string) string {
+		return fmt.Sprintf(`{"detail-type":"EC2 Instance State-change Notification","source":%q,"account":%q,`+
+			`"region":%q,"detail":{"instance-id":"i-1","state":"running"}}`, source, account, region)
+	}
+	environ := &env{AwsEventBridgeAccountID: "123456789012", AwsSqsRegion: "us-east-1", AwsEC2Regions: "us-east-1,eu-west-1"}
+	tests := []struct {
+		name    string
+		environ *env
+		mode    string
+		body    string
+		want    bool
+	}{
+		{"ec2 event", environ, "auto", event("aws.ec2", "123456789012", "eu-west-1"), true},
+		{"other account", environ, "auto", event("aws.ec2", "210987654321", "us-east-1"), false},
+		{"other region", environ, "auto", event("aws.ec2", "123456789012", "ap-south-1"), false},
+		{"other source", environ, "auto", event("custom.app", "123456789012", "us-east-1"), false},
+		{"not an event", environ, "auto", `{"Event": "autoscaling:EC2_INSTANCE_LAUNCH"}`, false},
+		{"envelopes only", environ, "false", event("aws.ec2", "123456789012", "us-east-1"), false},
+		{"queue owner account", &env{AwsSqsQueueOwnerAccountID: "123456789012", AwsSqsRegion: "us-east-1"}, "auto",
+			event("aws.ec2", "123456789012", "us-east-1"), true},
+		{"no account configured", &env{AwsSqsRegion: "us-east-1"}, "auto", event("aws.ec2", "123456789012", "us-east-1"), false},
+	}
+	for _, tt := range tests {
+		if got := tt.environ.trustRawMsg(tt.mode, tt.body); got != tt.want {
+			t.Errorf("%v: trustRawMsg() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+)
+
+const defaultMapDomainTagKey = "haproxy-domain"
+
+// hostMap maintains HAPROXY_MAP_FILE, mapping the domain in every instance's
+// HAPROXY_MAP_DOMAIN_TAG_KEY tag to its backend, in place of the config.
+type hostMap struct {
+	path      string
+	domainKey string
+}
+
+// newHostMap returns nil unless HAPROXY_MAP_FILE is set.
+func newHostMap(environ *env) *hostMap {
+	if environ.HaproxyMapFile == "" {
+		return nil
+	}
+	m := &hostMap{path: environ.HaproxyMapFile, domainKey: environ.HaproxyMapDomainTagKey}
+	if m.domainKey == "" {
+		m.domainKey = defaultMapDomainTagKey
+	}
+	return m
+}
+
+// entries maps domains to backends. A domain tagged in several backends
+// stays with the first one.
+func (m *hostMap) entries(data templateData) map[string]string {
+	entries := make(map[string]string)
+	for _, backend := range data.Backends {
+		for _, server := range backend.Servers {
+			domain := strings.ToLower(server.Tags[m.domainKey])
+			if domain == "" {
+				continue
+			}
+			if current, ok := entries[domain]; ok && current != backend.Name {
+				log.Printf("warning: %v is tagged in backends %v and %v, keeping %v\n", domain, current, backend.Name, current)
+				continue
+			}
+			entries[domain] = backend.Name
+		}
+	}
+	return entries
+}
+
+func renderMapFile(entries map[string]string) []byte {
+	domains := make([]string, 0, len(entries))
+	for domain := range entries {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	var buf bytes.Buffer
+	for _, domain := range domains {
+		fmt.Fprintf(&buf, "%s %s\n", domain, entries[domain])
+	}
+	return buf.Bytes()
+}
+
+// parseMap parses the output of "show map", one "id key value" per line.
+func parseMap(out string) map[string]string {
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 {
+			entries[fields[1]] = fields[2]
+		}
+	}
+	return entries
+}
+
+// updateRuntime changes only the entries that differ from what haproxy has
+// loaded.
+func (m *hostMap) updateRuntime(socket *runtimeSocket, entries map[string]string) error {
+	out, err := socket.command("show map " + m.path)
+	if err != nil {
+		return err
+	}
+	current := parseMap(out)
+	var commands []string
+	for domain, backend := range entries {
+		existing, ok := current[domain]
+		switch {
+		case !ok:
+			commands = append(commands, fmt.Sprintf("add map %s %s %s", m.path, domain, backend))
+		case existing != backend:
+			commands = append(commands, fmt.Sprintf("set map %s %s %s", m.path, domain, backend))
+		}
+	}
+	for domain := range current {
+		if _, ok := entries[domain]; !ok {
+			commands = append(commands, fmt.Sprintf("del map %s %s", m.path, domain))
+		}
+	}
+	for _, cmd := range commands {
+		_, err = socket.command(cmd)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("updated %d map entries at runtime\n", len(commands))
+	return nil
+}
+
+// applyMap writes the map file and updates haproxy over the runtime socket,
+// or reloads it when there is no socket or the update fails. It reports
+// whether haproxy was updated.
+func applyMap(w *configWriter, environ *env, data templateData) (bool, error) {
+	entries := w.hostMap.entries(data)
+	content := renderMapFile(entries)
+	existing, err := ioutil.ReadFile(w.hostMap.path)
+	if err == nil && bytes.Equal(existing, content) && !w.force && !w.reloadPending {
+		log.Println("no change to the map file, skipping update")
+		return false, nil
+	}
+	err = writeFileAtomic(w, w.hostMap.path, content)
+	if err != nil {
+		log.Println("error when writing map file: ", err)
+		return false, err
+	}
+	log.Printf("map file written with %d entries\n", len(entries))
+
+	if environ.reloadDisabled() {
+		return false, nil
+	}
+	if w.runtime != nil && !w.reloadRequired {
+		err = w.hostMap.updateRuntime(w.runtime, entries)
+		if err == nil {
+			return true, nil
+		}
+		log.Println("error when updating map at runtime, falling back to reloading haproxy: ", err)
+	}
+	err = reloadWithRetries(w, environ, newReloadContext(data))
+	if err == errReloadSuperseded {
+		w.reloadPending = true
+		return false, err
+	}
+	if err != nil {
+		return false, err
+	}
+	w.reloadPending = false
+	w.reloadRequired = false
+	return true, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// reloadMaster reloads a master-worker haproxy through the master CLI. Since
+// haproxy 2.7 the reply starts with Success=0 or Success=1 followed by the
+// startup logs of the new worker, older versions reply with nothing.
+func reloadMaster(socket *runtimeSocket) error {
+	log.Println("reloading haproxy through master socket: ", socket.path)
+	out, err := socket.command("reload")
+	if err != nil {
+		log.Println("error when reloading through master socket: ", err)
+		return err
+	}
+	status, logs := out, ""
+	if i := strings.Index(out, "\n"); i >= 0 {
+		status, logs = out[:i], strings.TrimSpace(out[i+1:])
+	}
+	logs = strings.TrimSpace(strings.TrimPrefix(logs, "--"))
+	if logs != "" {
+		log.Printf("output of master reload: %v\n", trimOutput(logs))
+	}
+	if strings.TrimSpace(status) == "Success=0" {
+		return fmt.Errorf("new haproxy worker failed to start")
+	}
+	return nil
+}
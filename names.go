@@ -0,0 +1,153 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const maxServerNameLength = 64
+
+// sanitizeServerName replaces everything but alphanumerics, dashes,
+// underscores and dots, which haproxy doesn't accept in a server name.
+func sanitizeServerName(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || r == '.' ||
+			r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '-'
+	}, name)
+	if len(sanitized) > maxServerNameLength {
+		sanitized = sanitized[:maxServerNameLength]
+	}
+	if sanitized == "" {
+		sanitized = "server"
+	}
+	return sanitized
+}
+
+// withSuffix appends suffix, truncating name to stay within
+// maxServerNameLength.
+func withSuffix(name, suffix string) string {
+	if len(name)+len(suffix) > maxServerNameLength {
+		name = name[:maxServerNameLength-len(suffix)]
+	}
+	return name + suffix
+}
+
+// uniqueServerNames returns a copy of the config with haproxy safe server
+// names. Names shared by several instances get the instance ID appended, so
+// every name is unique across all backends. Renamed servers are logged.
+func uniqueServerNames(groupNames []string, config map[string][]templateItem) map[string][]templateItem {
+	count := make(map[string]int)
+	for _, groupName := range groupNames {
+		for _, item := range config[groupName] {
+			count[sanitizeServerName(item.Name)]++
+		}
+	}
+
+	unique := make(map[string][]templateItem)
+	seen := make(map[string]bool)
+	for _, groupName := range groupNames {
+		items := make([]templateItem, len(config[groupName]))
+		for i, item := range config[groupName] {
+			name := sanitizeServerName(item.Name)
+			if count[name] > 1 && item.InstanceID != "" {
+				name = withSuffix(name, "-"+strings.TrimPrefix(item.InstanceID, "i-"))
+			}
+			// an instance in several groups, or one without an ID
+			base := name
+			for n := 2; seen[name]; n++ {
+				name = withSuffix(base, "-"+strconv.Itoa(n))
+			}
+			seen[name] = true
+			if name != item.Name {
+				log.Printf("server %v named %q as %q\n", item.InstanceID, item.Name, name)
+			}
+			item.Name = name
+			items[i] = item
+		}
+		unique[groupName] = items
+	}
+	return unique
+}
+
+const maxServerID = 65535
+
+// serverIDKey is what a server ID is derived from, the instance ID when
+// there is one.
+func serverIDKey(item templateItem) string {
+	if item.InstanceID != "" {
+		return item.InstanceID
+	}
+	return item.Address
+}
+
+// assignServerIDs sets a stable ID in 1-65535 derived from a hash of the
+// instance ID, so haproxy keeps stick table entries and server state across
+// reloads. Servers in previous keep the ID they were given before, new ones
+// resolve collisions by probing the next free ID in instance ID order, which
+// keeps the result deterministic. The config is modified in place and the
+// IDs are returned for the next call.
+func assignServerIDs(previous map[string]int, groupNames []string, config map[string][]templateItem) map[string]int {
+	var keys []string
+	for _, groupName := range groupNames {
+		for _, item := range config[groupName] {
+			keys = append(keys, serverIDKey(item))
+		}
+	}
+	sort.Strings(keys)
+
+	ids := make(map[string]int)
+	taken := make(map[int]string)
+	for _, key := range keys {
+		if id, ok := previous[key]; ok && taken[id] == "" {
+			ids[key] = id
+			taken[id] = key
+		}
+	}
+	for _, key := range keys {
+		if _, ok := ids[key]; ok {
+			continue
+		}
+		hash := fnv.New32a()
+		hash.Write([]byte(key))
+		id := int(hash.Sum32()%maxServerID) + 1
+		for taken[id] != "" {
+			log.Printf("warning: server id %d of %v collides with %v, probing\n", id, key, taken[id])
+			id = id%maxServerID + 1
+		}
+		ids[key] = id
+		taken[id] = key
+	}
+
+	for _, groupName := range groupNames {
+		for i, item := range config[groupName] {
+			config[groupName][i].ID = ids[serverIDKey(item)]
+		}
+	}
+	return ids
+}
+
+// serverIDTracker remembers the IDs of the last rendered config, so running
+// servers keep theirs when a new instance collides with them.
+type serverIDTracker struct {
+	mu  sync.Mutex
+	ids map[string]int
+}
+
+// assign sets the server IDs of config, see assignServerIDs. A nil tracker
+// assigns them without the previous ones.
+func (t *serverIDTracker) assign(groupNames []string, config map[string][]templateItem) {
+	if t == nil {
+		assignServerIDs(nil, groupNames, config)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ids = assignServerIDs(t.ids, groupNames, config)
+}
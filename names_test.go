@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeServerName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"web-1", "web-1"},
+		{"web / blue #3", "web---blue--3"},
+		{"api_v2.internal", "api_v2.internal"},
+		{"wéb-ñode", "w-b--ode"},
+		{"日本", "--"},
+		{"", "server"},
+		{strings.Repeat("a", 100), strings.Repeat("a", maxServerNameLength)},
+		{strings.Repeat("é", 40), strings.Repeat("-", 40)},
+	}
+	for _, tt := range tests {
+		if got := sanitizeServerName(tt.name); got != tt.want {
+			t.Errorf("sanitizeServerName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func serverNames(groupNames []string, config map[string][]templateItem) []string {
+	var names []string
+	for _, groupName := range groupNames {
+		for _, item := range config[groupName] {
+			names = append(names, item.Name)
+		}
+	}
+	return names
+}
+
+func TestUniqueServerNames(t *testing.T) {
+	long := strings.Repeat("w", 70)
+	tests := []struct {
+		name       string
+		groupNames []string
+		config     map[string][]templateItem
+		want       []string
+	}{
+		{
+			name:       "unique names are kept",
+			groupNames: []string{"web"},
+			config: map[string][]templateItem{"web": {
+				{Name: "web-1", InstanceID: "i-1"}, {Name: "web-2", InstanceID: "i-2"},
+			}},
+			want: []string{"web-1", "web-2"},
+		},
+		{
+			name:       "shared name gets the instance ID",
+			groupNames: []string{"web"},
+			config: map[string][]templateItem{"web": {
+				{Name: "web", InstanceID: "i-0abc"}, {Name: "web", InstanceID: "i-0def"},
+			}},
+			want: []string{"web-0abc", "web-0def"},
+		},
+		{
+			name:       "collision after sanitizing",
+			groupNames: []string{"web"},
+			config: map[string][]templateItem{"web": {
+				{Name: "web 1", InstanceID: "i-1"}, {Name: "web/1", InstanceID: "i-2"},
+			}},
+			want: []string{"web-1-1", "web-1-2"},
+		},
+		{
+			name:       "collision across backends",
+			groupNames: []string{"web", "api"},
+			config: map[string][]templateItem{
+				"web": {{Name: "app", InstanceID: "i-1"}},
+				"api": {{Name: "app", InstanceID: "i-2"}},
+			},
+			want: []string{"app-1", "app-2"},
+		},
+		{
+			name:       "instance in two groups",
+			groupNames: []string{"web", "api"},
+			config: map[string][]templateItem{
+				"web": {{Name: "app", InstanceID: "i-1"}},
+				"api": {{Name: "app", InstanceID: "i-1"}},
+			},
+			want: []string{"app-1", "app-1-2"},
+		},
+		{
+			name:       "no instance ID",
+			groupNames: []string{"web"},
+			config: map[string][]templateItem{"web": {
+				{Name: "static"}, {Name: "static"}, {Name: "static"},
+			}},
+			want: []string{"static", "static-2", "static-3"},
+		},
+		{
+			name:       "suffix within the length limit",
+			groupNames: []string{"web"},
+			config: map[string][]templateItem{"web": {
+				{Name: long, InstanceID: "i-0abc"}, {Name: long, InstanceID: "i-0def"},
+			}},
+			want: []string{
+				strings.Repeat("w", maxServerNameLength-5) + "-0abc",
+				strings.Repeat("w", maxServerNameLength-5) + "-0def",
+			},
+		},
+	}
+	for _, tt := range tests {
+		unique := uniqueServerNames(tt.groupNames, tt.config)
+		got := serverNames(tt.groupNames, unique)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: uniqueServerNames() = %q, want %q", tt.name, got, tt.want)
+		}
+		for _, name := range got {
+			if len(name) > maxServerNameLength {
+				t.Errorf("%v: name %q is longer than %d", tt.name, name, maxServerNameLength)
+			}
+		}
+	}
+}
+
+func TestUniqueServerNamesKeepsInput(t *testing.T) {
+	config := map[string][]templateItem{"web": {{Name: "web", InstanceID: "i-1"}, {Name: "web", InstanceID: "i-2"}}}
+	uniqueServerNames([]string{"web"}, config)
+	if config["web"][0].Name != "web" {
+		t.Errorf("uniqueServerNames() renamed the input to %q", config["web"][0].Name)
+	}
+}
+
+// collidingKeys returns two instance IDs, in sorted order, whose hashes give
+// the same server ID.
+func collidingKeys(t *testing.T) (string, string) {
+	seen := make(map[uint32]string)
+	for i := 0; i < 100000; i++ {
+		key := fmt.Sprintf("i-%08d", i)
+		hash := fnv.New32a()
+		hash.Write([]byte(key))
+		id := hash.Sum32() % maxServerID
+		if other, ok := seen[id]; ok {
+			return other, key
+		}
+		seen[id] = key
+	}
+	t.Fatal("no colliding instance IDs found")
+	return "", ""
+}
+
+func TestAssignServerIDsKeepsPreviousIDs(t *testing.T) {
+	first, second := collidingKeys(t)
+	groupNames := []string{"web"}
+
+	config := map[string][]templateItem{"web": {{Name: "b", InstanceID: second}}}
+	previous := assignServerIDs(nil, groupNames, config)
+	id := config["web"][0].ID
+
+	// the new instance sorts first and would take the running one's ID
+	config = map[string][]templateItem{"web": {{Name: "a", InstanceID: first}, {Name: "b", InstanceID: second}}}
+	fresh := assignServerIDs(nil, groupNames, config)
+	if fresh[first] != id {
+		t.Fatalf("expected %v to take ID %d without previous IDs, got %d", first, id, fresh[first])
+	}
+
+	config = map[string][]templateItem{"web": {{Name: "a", InstanceID: first}, {Name: "b", InstanceID: second}}}
+	ids := assignServerIDs(previous, groupNames, config)
+	if config["web"][1].ID != id || ids[second] != id {
+		t.Errorf("running server %v changed ID from %d to %d", second, id, config["web"][1].ID)
+	}
+	if config["web"][0].ID == id || config["web"][0].ID == 0 {
+		t.Errorf("new server %v got ID %d", first, config["web"][0].ID)
+	}
+}
+
+func TestServerIDTracker(t *testing.T) {
+	first, second := collidingKeys(t)
+	groupNames := []string{"web"}
+	tracker := &serverIDTracker{}
+
+	config := map[string][]templateItem{"web": {{InstanceID: second}}}
+	tracker.assign(groupNames, config)
+	id := config["web"][0].ID
+
+	config = map[string][]templateItem{"web": {{InstanceID: first}, {InstanceID: second}}}
+	tracker.assign(groupNames, config)
+	if config["web"][1].ID != id {
+		t.Errorf("running server changed ID from %d to %d", id, config["web"][1].ID)
+	}
+
+	var none *serverIDTracker
+	config = map[string][]templateItem{"web": {{InstanceID: second}}}
+	none.assign(groupNames, config)
+	if config["web"][0].ID != id {
+		t.Errorf("nil tracker assigned ID %d, want %d", config["web"][0].ID, id)
+	}
+}
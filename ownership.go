@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// fileOwnership is the mode and owner applied to every written config file.
+// A nil mode keeps the mode of the existing file, a uid or gid of -1 leaves
+// it unchanged.
+type fileOwnership struct {
+	mode *os.FileMode
+	uid  int
+	gid  int
+}
+
+// newFileOwnership parses HAPROXY_FILE_MODE as an octal mode and resolves
+// HAPROXY_FILE_OWNER and HAPROXY_FILE_GROUP, given by name or ID.
+func newFileOwnership(environ *env) (*fileOwnership, error) {
+	o := &fileOwnership{uid: -1, gid: -1}
+	if environ.HaproxyFileMode != "" {
+		mode, err := strconv.ParseUint(environ.HaproxyFileMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("invalid HAPROXY_FILE_MODE %q, expected an octal mode like 0640", environ.HaproxyFileMode)
+		}
+		fileMode := os.FileMode(mode)
+		o.mode = &fileMode
+	}
+	if environ.HaproxyFileOwner != "" {
+		owner, err := user.Lookup(environ.HaproxyFileOwner)
+		if err != nil {
+			owner, err = user.LookupId(environ.HaproxyFileOwner)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid HAPROXY_FILE_OWNER %q: %v", environ.HaproxyFileOwner, err)
+		}
+		o.uid, _ = strconv.Atoi(owner.Uid)
+	}
+	if environ.HaproxyFileGroup != "" {
+		group, err := user.LookupGroup(environ.HaproxyFileGroup)
+		if err != nil {
+			group, err = user.LookupGroupId(environ.HaproxyFileGroup)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid HAPROXY_FILE_GROUP %q: %v", environ.HaproxyFileGroup, err)
+		}
+		o.gid, _ = strconv.Atoi(group.Gid)
+	}
+	return o, nil
+}
+
+// apply sets the mode and owner of a file about to replace dest. Failing to
+// change the owner is only logged, it needs root.
+func (o *fileOwnership) apply(f *os.File, dest string) error {
+	mode := configFileMode(dest)
+	if o.mode != nil {
+		mode = *o.mode
+	}
+	err := f.Chmod(mode)
+	if err != nil {
+		return err
+	}
+
+	if o.uid == -1 && o.gid == -1 {
+		return nil
+	}
+	err = f.Chown(o.uid, o.gid)
+	if err != nil {
+		log.Printf("warning: can't change owner of %v to %d:%d, running as uid %d (not root?): %v\n",
+			dest, o.uid, o.gid, os.Geteuid(), err)
+	}
+	return nil
+}
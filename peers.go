@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"strconv"
+)
+
+const (
+	defaultPeersPort       = 10000
+	defaultPeersPortTagKey = "haproxy-peer-port"
+)
+
+// templatePeer is an instance of AWS_EC2_PEERS_GROUP_NAME, for the peers
+// section. Local is set for the instance this runs on.
+type templatePeer struct {
+	Name  string
+	Host  string
+	Port  int
+	Local bool
+}
+
+func (e *env) peersPort() int {
+	if e.HaproxyPeersPort > 0 {
+		return e.HaproxyPeersPort
+	}
+	return defaultPeersPort
+}
+
+func (e *env) peersPortTagKey() string {
+	if e.HaproxyPeersPortTagKey != "" {
+		return e.HaproxyPeersPortTagKey
+	}
+	return defaultPeersPortTagKey
+}
+
+// discoveryGroups returns the groups to discover, the backend groups and
+// the peers group.
+func (e *env) discoveryGroups() []string {
+	groups := e.groupNames()
+	if e.AwsEC2PeersGroupName != "" {
+		groups = append(groups, e.AwsEC2PeersGroupName)
+	}
+	return groups
+}
+
+// backendGroups leaves the peers group out of groupNames.
+func (o *discoveryOptions) backendGroups(groupNames []string) []string {
+	if o.peersGroupName == "" {
+		return groupNames
+	}
+	var groups []string
+	for _, groupName := range groupNames {
+		if groupName != o.peersGroupName {
+			groups = append(groups, groupName)
+		}
+	}
+	return groups
+}
+
+// withoutPeers returns a copy of config without the peers group. Its
+// instances are reached on the peer port, so the checks probing and counting
+// servers leave them out.
+func (o *discoveryOptions) withoutPeers(config map[string][]templateItem) map[string][]templateItem {
+	if _, ok := config[o.peersGroupName]; !ok {
+		return config
+	}
+	servers := make(map[string][]templateItem, len(config))
+	for groupName, items := range config {
+		if groupName != o.peersGroupName {
+			servers[groupName] = items
+		}
+	}
+	return servers
+}
+
+// newPeers turns the instances of the peers group into peers named by their
+// instance ID, as the members of a group usually share their Name tag. The
+// port comes from the HAPROXY_PEERS_PORT_TAG_KEY tag, or HAPROXY_PEERS_PORT.
+func newPeers(opts *discoveryOptions, items []templateItem) []templatePeer {
+	var peers []templatePeer
+	seen := make(map[string]bool)
+	for _, item := range items {
+		name := item.InstanceID
+		if name == "" {
+			name = sanitizeServerName(item.Name)
+		}
+		if seen[name] {
+			log.Printf("warning: skipping duplicate peer %v (%v)\n", name, item.Host)
+			continue
+		}
+		seen[name] = true
+
+		port := opts.peersPort
+		if value, ok := item.Tags[opts.peersPortTagKey]; ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				log.Printf("warning: invalid peer port %q on %v, using %d\n", value, item.InstanceID, port)
+			} else {
+				port = parsed
+			}
+		}
+		peers = append(peers, templatePeer{
+			Name:  name,
+			Host:  item.Host,
+			Port:  port,
+			Local: opts.localInstanceID != "" && item.InstanceID == opts.localInstanceID,
+		})
+	}
+	return peers
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// pidCheck verifies a reload started a new haproxy process, by comparing the
+// pids in HAPROXY_PID_FILE, or the workers the master socket reports in
+// master mode, before and after the reload.
+type pidCheck struct {
+	pidFile string
+	master  *runtimeSocket
+}
+
+// newPidCheck returns nil when there is nothing to read the pids from.
+func newPidCheck(environ *env) *pidCheck {
+	c := &pidCheck{pidFile: environ.HaproxyPidFile}
+	if environ.reloadMode() == reloadModeMaster {
+		c.master = &runtimeSocket{path: environ.HaproxyMasterSocket}
+	}
+	if c.pidFile == "" && c.master == nil {
+		return nil
+	}
+	return c
+}
+
+// pids returns the pids of the running haproxy processes, nil when they
+// can't be read.
+func (c *pidCheck) pids() []string {
+	if c == nil {
+		return nil
+	}
+	if c.master != nil {
+		out, err := c.master.command("show proc")
+		if err != nil {
+			log.Println("error when reading haproxy processes: ", err)
+			return nil
+		}
+		return workerPids(out)
+	}
+	content, err := ioutil.ReadFile(c.pidFile)
+	if err != nil {
+		log.Println("error when reading haproxy pid file: ", err)
+		return nil
+	}
+	return strings.Fields(string(content))
+}
+
+// workerPids parses the worker pids from the output of "show proc".
+func workerPids(out string) []string {
+	var pids []string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[1] == "worker" {
+			pids = append(pids, fields[0])
+		}
+	}
+	return pids
+}
+
+// verify fails when no new pid showed up although the config changed.
+func (c *pidCheck) verify(previous []string, configChanged bool) error {
+	if c == nil {
+		return nil
+	}
+	current := c.pids()
+	log.Printf("haproxy pids before reload %v, after %v\n", previous, current)
+	if current == nil || previous == nil {
+		// can't tell, the read error is logged
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, pid := range previous {
+		known[pid] = true
+	}
+	for _, pid := range current {
+		if !known[pid] {
+			return nil
+		}
+	}
+	if !configChanged {
+		return nil
+	}
+	return fmt.Errorf("no new haproxy process after reload, still running %v", strings.Join(current, " "))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// poisonHandler drops messages that were received too many times, after
+// optionally forwarding them to a dead-letter queue.
+type poisonHandler struct {
+	sqsClient       *sqs.SQS
+	maxReceiveCount int
+	deadLetterURL   *string
+
+	mu    sync.Mutex
+	count int
+}
+
+func newPoisonHandler(sqsClient *sqs.SQS, environ *env) (*poisonHandler, error) {
+	p := &poisonHandler{
+		sqsClient:       sqsClient,
+		maxReceiveCount: environ.maxReceiveCount(),
+	}
+	if environ.AwsSqsDeadLetterQueueName != "" {
+		deadLetterURL, err := getQueueURL(sqsClient, environ.AwsSqsDeadLetterQueueName, environ.AwsSqsQueueOwnerAccountID)
+		if err != nil {
+			return nil, err
+		}
+		p.deadLetterURL = deadLetterURL
+	}
+	return p, nil
+}
+
+// exceeded reports whether the message was received more often than allowed.
+// Messages without the ApproximateReceiveCount attribute never are.
+func (p *poisonHandler) exceeded(msg *sqs.Message) bool {
+	return receiveCount(msg) > p.maxReceiveCount
+}
+
+// drop logs the full message, forwards it to the dead-letter queue when one
+// is configured and counts it. The caller deletes it from the queue.
+func (p *poisonHandler) drop(msg *sqs.Message, reason interface{}) {
+	p.mu.Lock()
+	p.count++
+	count := p.count
+	p.mu.Unlock()
+
+	log.Printf("ERROR: dropping poison msg after %d receives (%v), %d poison msg(s) so far: %v\n",
+		receiveCount(msg), reason, count, aws.StringValue(msg.Body))
+
+	if p.deadLetterURL == nil {
+		return
+	}
+	_, err := p.sqsClient.SendMessage(&sqs.SendMessageInput{
+		QueueUrl:    p.deadLetterURL,
+		MessageBody: msg.Body,
+	})
+	if err != nil {
+		log.Println("error when forwarding msg to the dead-letter queue: ", err)
+	}
+}
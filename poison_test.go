@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+func TestPoisonExceeded(t *testing.T) {
+	p := &poisonHandler{maxReceiveCount: (&env{}).maxReceiveCount()}
+	tests := []struct {
+		name       string
+		attributes map[string]*string
+		want       bool
+	}{
+		{"attributes absent", nil, false},
+		{"attribute absent", map[string]*string{"SentTimestamp": aws.String("1600000000000")}, false},
+		{"attribute empty", map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: nil}, false},
+		{"attribute invalid", map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("many")}, false},
+		{"below", map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("1")}, false},
+		{"at max", map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("5")}, false},
+		{"above max", map[string]*string{sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("6")}, true},
+	}
+	for _, tt := range tests {
+		msg := &sqs.Message{Body: aws.String("{}"), Attributes: tt.attributes}
+		if got := p.exceeded(msg); got != tt.want {
+			t.Errorf("%v: exceeded() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPoisonDropCounts(t *testing.T) {
+	p := &poisonHandler{maxReceiveCount: 1}
+	msg := &sqs.Message{Body: aws.String("not json")}
+	p.drop(msg, "invalid body")
+	p.drop(msg, "invalid body")
+	if p.count != 2 {
+		t.Errorf("drop() counted %d poison msg(s), want 2", p.count)
+	}
+}
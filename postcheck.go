@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPostCheckTimeout = 10 * time.Second
+	postCheckInterval       = 500 * time.Millisecond
+)
+
+// postCheck verifies haproxy came back after the reload script exited, by
+// connecting to HAPROXY_POSTCHECK_ADDR and by waiting for the pid reported
+// on HAPROXY_POSTCHECK_SOCKET to change. Either one is optional.
+type postCheck struct {
+	addr    string
+	socket  *runtimeSocket
+	timeout time.Duration
+}
+
+// newPostCheck returns nil when neither check is configured.
+func newPostCheck(environ *env) *postCheck {
+	if environ.HaproxyPostcheckAddr == "" && environ.HaproxyPostcheckSocket == "" {
+		return nil
+	}
+	c := &postCheck{
+		addr:    environ.HaproxyPostcheckAddr,
+		timeout: defaultPostCheckTimeout,
+	}
+	if environ.HaproxyPostcheckSocket != "" {
+		c.socket = &runtimeSocket{path: environ.HaproxyPostcheckSocket}
+	}
+	if environ.HaproxyPostcheckTimeoutSeconds > 0 {
+		c.timeout = time.Duration(environ.HaproxyPostcheckTimeoutSeconds) * time.Second
+	}
+	return c
+}
+
+// pid returns the pid haproxy reports in "show info", or "" when there's no
+// socket check or haproxy can't be reached.
+func (c *postCheck) pid() string {
+	if c == nil || c.socket == nil {
+		return ""
+	}
+	out, err := c.socket.command("show info")
+	if err != nil {
+		return ""
+	}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) == 2 && parts[0] == "Pid" {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+// verify polls until every configured check passes or the timeout expires.
+// previousPid is the pid from before the reload.
+func (c *postCheck) verify(previousPid string) error {
+	if c == nil {
+		return nil
+	}
+	deadline := time.Now().Add(c.timeout)
+	var err error
+	for {
+		err = c.probe(previousPid)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("haproxy post-reload check failed after %v: %v", c.timeout, err)
+		}
+		time.Sleep(postCheckInterval)
+	}
+}
+
+func (c *postCheck) probe(previousPid string) error {
+	if c.socket != nil {
+		pid := c.pid()
+		if pid == "" {
+			return fmt.Errorf("no pid on %v", c.socket.path)
+		}
+		if pid == previousPid {
+			return fmt.Errorf("pid %v unchanged", pid)
+		}
+	}
+	if c.addr == "" {
+		return nil
+	}
+	if strings.HasPrefix(c.addr, "http://") || strings.HasPrefix(c.addr, "https://") {
+		client := &http.Client{Timeout: postCheckInterval * 2}
+		resp, err := client.Get(c.addr)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("%v returned %v", c.addr, resp.Status)
+		}
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", c.addr, postCheckInterval*2)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultProbeTimeout = 2 * time.Second
+	defaultProbeWorkers = 10
+)
+
+// probeOptions configures the optional TCP reachability probe.
+type probeOptions struct {
+	port            int
+	timeout         time.Duration
+	workers         int
+	skipUnreachable bool
+}
+
+func newProbeOptions(environ *env) *probeOptions {
+	opts := &probeOptions{
+		port:            environ.HealthProbePort,
+		timeout:         defaultProbeTimeout,
+		workers:         defaultProbeWorkers,
+		skipUnreachable: environ.HealthProbeSkipUnreachable,
+	}
+	if environ.HealthProbeTimeout > 0 {
+		opts.timeout = time.Duration(environ.HealthProbeTimeout) * time.Second
+	}
+	if environ.HealthProbeWorkers > 0 {
+		opts.workers = environ.HealthProbeWorkers
+	}
+	return opts
+}
+
+func (o *probeOptions) enabled() bool {
+	return o.port > 0
+}
+
+func probeTCP(host string, port int, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeTemplateItems connects to every item concurrently, using at most
+// workers connections at once, and sets Healthy accordingly. Unreachable
+// items are dropped when skipUnreachable is set.
+func probeTemplateItems(items []templateItem, opts *probeOptions) []templateItem {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < opts.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				err := probeTCP(items[i].Host, opts.port, opts.timeout)
+				items[i].Healthy = err == nil
+				if err != nil {
+					log.Printf("probe of %v (%v:%d) failed: %v\n", items[i].Name, items[i].Host, opts.port, err)
+				} else {
+					log.Printf("probe of %v (%v:%d) succeeded\n", items[i].Name, items[i].Host, opts.port)
+				}
+			}
+		}()
+	}
+	for i := range items {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if !opts.skipUnreachable {
+		return items
+	}
+	var reachable []templateItem
+	for _, item := range items {
+		if item.Healthy {
+			reachable = append(reachable, item)
+		} else {
+			log.Printf("skipping unreachable instance %v\n", item.Name)
+		}
+	}
+	return reachable
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// headerPrefix starts every line of the provenance header, which is how
+// it's told apart from the rendered body.
+const headerPrefix = "# haproxyconf "
+
+// provenanceHeader describes where a config comes from. The hash covers the
+// body only, so it's the same for configs that differ just in the header.
+func provenanceHeader(data templateData, body []byte) []byte {
+	trigger := data.Trigger
+	if trigger == "" {
+		trigger = "-"
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%sgenerated at %v\n", headerPrefix, data.GeneratedAt.Format("2006-01-02T15:04:05Z07:00"))
+	fmt.Fprintf(&buf, "%strigger %v\n", headerPrefix, trigger)
+	fmt.Fprintf(&buf, "%sgroups %v\n", headerPrefix, data.Group)
+	fmt.Fprintf(&buf, "%sservers %d\n", headerPrefix, data.Count)
+	fmt.Fprintf(&buf, "%sbody sha256 %x\n", headerPrefix, sha256.Sum256(body))
+	return buf.Bytes()
+}
+
+// stripHeader returns the content without the leading provenance header.
+func stripHeader(content []byte) []byte {
+	reader := bufio.NewReader(bytes.NewReader(content))
+	offset := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil || !bytes.HasPrefix(line, []byte(headerPrefix)) {
+			return content[offset:]
+		}
+		offset += len(line)
+	}
+}
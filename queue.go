@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	defaultBatchSize       = 10
+	maxBatchSize           = 10
+	defaultMaxReceiveCount = 5
+	maxWaitTimeSeconds     = 20
+	maxVisibilityTimeout   = 43200
+
+	defaultMaxDrain = 60 * time.Second
+	deleteAttempts  = 3
+
+	receiveBackoffMin         = time.Second
+	receiveBackoffMax         = 60 * time.Second
+	defaultMaxReceiveFailures = 10
+)
+
+// errStaleMessage is returned by handleMessage for messages older than
+// MAX_MESSAGE_AGE_SECONDS. They are deleted without regenerating the config.
+var errStaleMessage = errors.New("message is stale")
+
+// isStale reports whether the message is older than MAX_MESSAGE_AGE_SECONDS.
+// Messages without a timestamp are never stale.
+func (e *env) isStale(msgBody *snsMsg, now time.Time) bool {
+	if e.MaxMessageAgeSeconds <= 0 || msgBody.Timestamp.IsZero() {
+		return false
+	}
+	return now.Sub(msgBody.Timestamp) > time.Duration(e.MaxMessageAgeSeconds)*time.Second
+}
+
+// receiveOptions holds the long polling settings passed to ReceiveMessage.
+type receiveOptions struct {
+	waitTimeSeconds   *int64
+	visibilityTimeout *int64
+}
+
+// parseSeconds parses an optional seconds value and checks it is within
+// [0, max]. An empty value returns nil so the default applies.
+func parseSeconds(name, raw string, max int64) (*int64, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	seconds, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || seconds < 0 || seconds > max {
+		return nil, fmt.Errorf("invalid %v %q, expected 0-%d", name, raw, max)
+	}
+	return &seconds, nil
+}
+
+// newReceiveOptions validates the SQS long polling settings. The wait time
+// defaults to defaultWaitTimeSeconds and the visibility timeout to the one
+// of the queue.
+func newReceiveOptions(environ *env) (*receiveOptions, error) {
+	waitTimeSeconds, err := parseSeconds("SQS_WAIT_TIME_SECONDS", environ.SqsWaitTimeSeconds, maxWaitTimeSeconds)
+	if err != nil {
+		return nil, err
+	}
+	if waitTimeSeconds == nil {
+		waitTimeSeconds = aws.Int64(defaultWaitTimeSeconds)
+	}
+	visibilityTimeout, err := parseSeconds("SQS_VISIBILITY_TIMEOUT_SECONDS", environ.SqsVisibilityTimeoutSeconds, maxVisibilityTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &receiveOptions{
+		waitTimeSeconds:   waitTimeSeconds,
+		visibilityTimeout: visibilityTimeout,
+	}, nil
+}
+
+// queueNames returns the queues to consume from. AWS_SQS_QUEUE_NAMES takes a
+// comma separated list, AWS_SQS_QUEUE_NAME is used when it's empty.
+func (e *env) queueNames() []string {
+	names := splitList(e.AwsSqsQueueNames)
+	if len(names) == 0 {
+		names = append(names, e.AwsSqsQueueName)
+	}
+	return names
+}
+
+// batchSize returns how many messages are received per ReceiveMessage call.
+func (e *env) batchSize() int {
+	if e.AwsSqsBatchSize <= 0 {
+		return defaultBatchSize
+	}
+	if e.AwsSqsBatchSize > maxBatchSize {
+		return maxBatchSize
+	}
+	return e.AwsSqsBatchSize
+}
+
+// maxReceiveCount returns after how many failed attempts a message is dropped.
+func (e *env) maxReceiveCount() int {
+	if e.MaxReceiveCount > 0 {
+		return e.MaxReceiveCount
+	}
+	return defaultMaxReceiveCount
+}
+
+// receiveCount returns the ApproximateReceiveCount of a message, or 0 when
+// the attribute is missing.
+func receiveCount(msg *sqs.Message) int {
+	count, err := strconv.Atoi(aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]))
+	if err != nil {
+		return 0
+	}
+	return count
+}
+
+// queueNameFromURL returns the queue name, the last path element of the URL.
+func queueNameFromURL(queueURL string) string {
+	return queueURL[strings.LastIndex(queueURL, "/")+1:]
+}
+
+// queueURLError tells apart a queue that doesn't exist, or isn't visible to
+// this account, from one that exists but can't be accessed.
+func queueURLError(queueName, ownerAccountID string, err error) error {
+	owner := "this account"
+	if ownerAccountID != "" {
+		owner = "account " + ownerAccountID
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case sqs.ErrCodeQueueDoesNotExist:
+			return fmt.Errorf("queue %v not found in %v: %v", queueName, owner, err)
+		case "AccessDenied", "AccessDeniedException":
+			return fmt.Errorf("access to queue %v in %v denied, check the queue policy and sqs:GetQueueUrl permission: %v",
+				queueName, owner, err)
+		}
+	}
+	return fmt.Errorf("error when resolving queue %v in %v: %v", queueName, owner, err)
+}
+
+// isFIFOQueue reports whether the queue name refers to a FIFO queue.
+func isFIFOQueue(queueName string) bool {
+	return strings.HasSuffix(queueName, ".fifo")
+}
+
+// receiveAttributes returns the system attributes requested with every
+// message. FIFO queues additionally return the ordering attributes.
+func receiveAttributes(fifo bool) []*string {
+	names := []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)}
+	if fifo {
+		names = append(names,
+			aws.String(sqs.MessageSystemAttributeNameMessageGroupId),
+			aws.String(sqs.MessageSystemAttributeNameSequenceNumber),
+			aws.String(sqs.MessageSystemAttributeNameMessageDeduplicationId))
+	}
+	return names
+}
+
+// dedupID returns the key a message is deduplicated by, the
+// MessageDeduplicationId of FIFO queues when present, the SNS MessageID
+// otherwise.
+func dedupID(msg *sqs.Message, msgBody *snsMsg) string {
+	id := aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameMessageDeduplicationId])
+	if id != "" {
+		return id
+	}
+	return msgBody.MessageID
+}
+
+// queueConsumer polls a single queue. Several consumers share the poison
+// handler and the updater, which serializes the config regeneration.
+type queueConsumer struct {
+	sqsClient   *sqs.SQS
+	queueName   string
+	queueURL    *string
+	fifo        bool
+	receiveOpts *receiveOptions
+	batchSize   int
+	maxFailures int
+	maxDrain    time.Duration
+	poison      *poisonHandler
+	updater     *configUpdater
+
+	draining   bool
+	drainStart time.Time
+	drained    int
+}
+
+// maxDrain returns for how long a backlog is drained before the held
+// updates are applied regardless.
+func (e *env) maxDrain() time.Duration {
+	if e.MaxDrainSeconds > 0 {
+		return time.Duration(e.MaxDrainSeconds) * time.Second
+	}
+	return defaultMaxDrain
+}
+
+// startDrain puts config updates on hold until the backlog of the queue is
+// drained, so it results in a single regeneration.
+func (c *queueConsumer) startDrain() {
+	log.Println("draining backlog of queue: ", c.queueName)
+	c.draining = true
+	c.drainStart = time.Now()
+	c.drained = 0
+	c.updater.hold()
+}
+
+func (c *queueConsumer) endDrain() {
+	log.Printf("drained %d messages from %v in %v\n", c.drained, c.queueName,
+		time.Since(c.drainStart).Round(time.Millisecond))
+	c.draining = false
+	err := c.updater.release()
+	if err != nil {
+		log.Println("error when updating config after drain: ", err)
+	}
+}
+
+// maxReceiveFailures returns after how many consecutive ReceiveMessage
+// failures the process exits.
+func (e *env) maxReceiveFailures() int {
+	if e.AwsSqsMaxReceiveFailures > 0 {
+		return e.AwsSqsMaxReceiveFailures
+	}
+	return defaultMaxReceiveFailures
+}
+
+// poll consumes the queue until ctx is canceled. A canceled long poll returns
+// right away, a batch that is being handled is finished and deleted first.
+func (c *queueConsumer) poll(ctx context.Context) {
+	log.Println("consume from queue:", *c.queueURL)
+	failures := 0
+	backoff := receiveBackoffMin
+	stale := 0
+	c.startDrain()
+	defer func() {
+		if c.draining {
+			c.endDrain()
+		}
+	}()
+	for ctx.Err() == nil {
+		waitTimeSeconds := c.receiveOpts.waitTimeSeconds
+		if c.draining {
+			waitTimeSeconds = aws.Int64(0)
+		}
+		resp, err := c.sqsClient.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            c.queueURL,
+			WaitTimeSeconds:     waitTimeSeconds,
+			VisibilityTimeout:   c.receiveOpts.visibilityTimeout,
+			MaxNumberOfMessages: aws.Int64(int64(c.batchSize)),
+			AttributeNames:      receiveAttributes(c.fifo),
+		})
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			failures++
+			if failures >= c.maxFailures {
+				log.Fatalf("giving up after %d failed receives from %v: %v\n", failures, c.queueName, err)
+			}
+			log.Printf("error when receiving message from %v, retrying in %v: %v\n", c.queueName, backoff, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > receiveBackoffMax {
+				backoff = receiveBackoffMax
+			}
+			if c.draining && time.Since(c.drainStart) > c.maxDrain {
+				c.endDrain()
+			}
+			continue
+		}
+		failures = 0
+		backoff = receiveBackoffMin
+
+		var handled []*sqs.Message
+		// a FIFO message that failed blocks the rest of its group in this
+		// batch, they are received again in order once it is retried
+		failedGroups := make(map[string]bool)
+		batchStale := 0
+		for _, msg := range resp.Messages {
+			group := aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameMessageGroupId])
+			if c.fifo {
+				log.Printf("received msg %v from group %v, sequence number %v\n", aws.StringValue(msg.MessageId),
+					group, aws.StringValue(msg.Attributes[sqs.MessageSystemAttributeNameSequenceNumber]))
+				if failedGroups[group] {
+					log.Printf("leaving message on queue %v behind failed msg of group %v\n", c.queueName, group)
+					continue
+				}
+			}
+			if c.poison.exceeded(msg) {
+				c.poison.drop(msg, "receive count exceeded")
+				handled = append(handled, msg)
+				continue
+			}
+			err := c.updater.handleMessage(msg)
+			if err == errStaleMessage {
+				batchStale++
+				handled = append(handled, msg)
+				continue
+			}
+			if err != nil && receiveCount(msg) >= c.poison.maxReceiveCount {
+				c.poison.drop(msg, err)
+			} else if err != nil {
+				log.Printf("leaving message on queue %v: %v\n", c.queueName, err)
+				failedGroups[group] = true
+				continue
+			}
+			handled = append(handled, msg)
+		}
+		deleteMessages(c.sqsClient, c.queueURL, handled)
+		c.drained += len(handled)
+
+		// once the stale backlog is drained, catch up with one full update
+		stale += batchStale
+		if stale > 0 && batchStale == 0 {
+			log.Printf("discarded %d stale messages from %v, regenerating config\n", stale, c.queueName)
+			err := c.updater.requestUpdate(true)
+			if err != nil {
+				log.Println("error when regenerating config: ", err)
+			} else {
+				stale = 0
+			}
+		}
+
+		if c.draining && (len(resp.Messages) == 0 || time.Since(c.drainStart) > c.maxDrain) {
+			c.endDrain()
+		} else if !c.draining && len(resp.Messages) == c.batchSize {
+			c.startDrain()
+		}
+
+		if c.updater.opts.warmup.due(time.Now()) {
+			log.Println("warm-up elapsed, re-rendering config")
+			err := c.updater.requestUpdate(false)
+			if err != nil {
+				log.Println("error when re-rendering config: ", err)
+			}
+		}
+	}
+}
+
+// deleteFailures counts the messages that couldn't be deleted. They are
+// received again after the visibility timeout, which is harmless since the
+// deduper and the unchanged config check make reprocessing a no-op.
+var deleteFailures uint64
+
+// deleteMessages removes handled messages from the queue, retrying the ones
+// that failed up to deleteAttempts times.
+func deleteMessages(sqsClient *sqs.SQS, queueURL *string, msgs []*sqs.Message) {
+	for attempt := 0; attempt < deleteAttempts && len(msgs) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoffDelay(attempt))
+		}
+		msgs = deleteBatch(sqsClient, queueURL, msgs)
+	}
+	for _, msg := range msgs {
+		failures := atomic.AddUint64(&deleteFailures, 1)
+		log.Printf("warning: failed to delete msg %v with receipt handle %v, %d delete failures so far\n",
+			aws.StringValue(msg.MessageId), aws.StringValue(msg.ReceiptHandle), failures)
+	}
+}
+
+// deleteBatch deletes the messages and returns the ones that failed, a batch
+// of one is deleted with a plain DeleteMessage call.
+func deleteBatch(sqsClient *sqs.SQS, queueURL *string, msgs []*sqs.Message) []*sqs.Message {
+	if len(msgs) == 1 {
+		_, err := sqsClient.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      queueURL,
+			ReceiptHandle: msgs[0].ReceiptHandle,
+		})
+		if err != nil {
+			log.Println("error when deleting message: ", err)
+			return msgs
+		}
+		return nil
+	}
+
+	var entries []*sqs.DeleteMessageBatchRequestEntry
+	for i, msg := range msgs {
+		entries = append(entries, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: msg.ReceiptHandle,
+		})
+	}
+
+	output, err := sqsClient.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		QueueUrl: queueURL,
+		Entries:  entries,
+	})
+	if err != nil {
+		log.Println("error when deleting message batch: ", err)
+		return msgs
+	}
+	var failed []*sqs.Message
+	for _, entry := range output.Failed {
+		log.Printf("error when deleting message %v: %v %v\n",
+			aws.StringValue(entry.Id), aws.StringValue(entry.Code), aws.StringValue(entry.Message))
+		i, err := strconv.Atoi(aws.StringValue(entry.Id))
+		if err == nil && i >= 0 && i < len(msgs) {
+			failed = append(failed, msgs[i])
+		}
+	}
+	return failed
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// regionClient bundles the clients used for discovery in a single region,
+// together with the last instance lists it fetched successfully.
+type regionClient struct {
+	region            string
+	ec2Client         ec2iface.EC2API
+	autoScalingClient *autoscaling.AutoScaling
+	lastInstances     map[string][]*internalInstance
+	// missingAddress counts the instances the last lookup of a group left
+	// out because they don't have an address yet
+	missingAddress map[string]int
+}
+
+// regions returns the regions to discover instances in. AWS_EC2_REGIONS takes
+// a comma separated list and defaults to the SQS region.
+func (e *env) regions() []string {
+	regions := splitList(e.AwsEC2Regions)
+	if len(regions) == 0 {
+		regions = append(regions, e.AwsSqsRegion)
+	}
+	return regions
+}
+
+// newSession returns the base session. Access keys from the environment are
+// used when AWS_ACCESS_KEY_ID is set, otherwise the SDK's default chain
+// picks the credentials: the environment, the shared config files or the
+// instance profile.
+func newSession(environ *env) (*session.Session, error) {
+	config := aws.Config{Region: aws.String(environ.AwsSqsRegion)}
+	if environ.AwsAccessKeyID != "" {
+		config.Credentials = credentials.NewEnvCredentials()
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := sess.Config.Credentials.Get()
+	if err != nil {
+		log.Println("warning: no AWS credentials found: ", err)
+	} else {
+		log.Println("using AWS credentials from: ", value.ProviderName)
+	}
+	return sess, nil
+}
+
+// newEC2Session returns the session used for discovery. When a role ARN is
+// configured it is assumed through STS, the credentials are refreshed
+// automatically before they expire.
+func newEC2Session(sess *session.Session, roleARN, externalID string) (*session.Session, error) {
+	if roleARN == "" {
+		return sess, nil
+	}
+
+	creds := stscreds.NewCredentials(sess, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		if externalID != "" {
+			p.ExternalID = aws.String(externalID)
+		}
+	})
+	if _, err := creds.Get(); err != nil {
+		return nil, err
+	}
+
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
+
+func newRegionClients(sess *session.Session, regions []string) []*regionClient {
+	var clients []*regionClient
+	for _, region := range regions {
+		regionSession := sess.Copy(&aws.Config{Region: aws.String(region)})
+		clients = append(clients, &regionClient{
+			region:            region,
+			ec2Client:         ec2.New(regionSession),
+			autoScalingClient: autoscaling.New(regionSession),
+			lastInstances:     make(map[string][]*internalInstance),
+			missingAddress:    make(map[string]int),
+		})
+	}
+	return clients
+}
+
+// countMissingAddress returns the number of instances that don't have the
+// address the endpoint type uses yet, which happens while a pending
+// instance's ENI is attached or its public IP is assigned.
+func countMissingAddress(instances []*internalInstance, endpointType string) int {
+	missing := 0
+	for _, instance := range instances {
+		if !instance.hasEndpoint(endpointType) {
+			missing++
+		}
+	}
+	return missing
+}
+
+// fetchInstanceList runs the discovery. Instances that don't have an address
+// yet are left out and counted in missingAddress, so the caller can repeat
+// the discovery a bit later.
+func (rc *regionClient) fetchInstanceList(opts *discoveryOptions, groupName string) ([]*internalInstance, error) {
+	var instances []*internalInstance
+	var err error
+	if opts.autoScalingGroupName != "" {
+		instances, err = getInstanceListFromAutoScalingGroup(rc, opts, groupName)
+	} else {
+		instances, err = getInstanceListFromGroup(rc, opts, groupName, nil)
+	}
+	if err != nil {
+		delete(rc.missingAddress, groupName)
+		return nil, err
+	}
+
+	var withAddress []*internalInstance
+	for _, instance := range instances {
+		if !instance.hasEndpoint(opts.endpointType) {
+			log.Printf("skipping instance %v: no %v address yet\n", instance.instanceID, opts.endpointType)
+			continue
+		}
+		withAddress = append(withAddress, instance)
+	}
+	rc.missingAddress[groupName] = countMissingAddress(instances, opts.endpointType)
+	return withAddress, nil
+}
+
+// missingAddresses returns the number of instances the last discovery in
+// all regions left out for not having an address yet.
+func missingAddresses(regionClients []*regionClient) int {
+	missing := 0
+	for _, rc := range regionClients {
+		for _, count := range rc.missingAddress {
+			missing += count
+		}
+	}
+	return missing
+}
+
+// getEC2ConfigWaitingForAddresses runs the discovery and repeats it a few
+// times while some instances are still missing their address. It sleeps in
+// between, the updater defers its retries instead.
+func getEC2ConfigWaitingForAddresses(regionClients []*regionClient, opts *discoveryOptions, groupNames []string) (map[string][]templateItem, error) {
+	for attempt := 1; ; attempt++ {
+		config, err := getEC2Config(regionClients, opts, groupNames)
+		missing := missingAddresses(regionClients)
+		if err != nil || missing == 0 || attempt >= opts.addressRetryAttempts {
+			return config, err
+		}
+		log.Printf("%d instance(s) without an address yet, retrying in %v\n", missing, opts.addressRetryInterval)
+		time.Sleep(opts.addressRetryInterval)
+	}
+}
+
+// getInstanceList discovers the instances of a group in this region. When
+// the lookup fails and keepStale is set, the last known list is returned
+// instead of an error.
+func (rc *regionClient) getInstanceList(opts *discoveryOptions, groupName string) ([]*internalInstance, error) {
+	instances, err := rc.fetchInstanceList(opts, groupName)
+	if err == nil && opts.skipImpaired {
+		err = markImpaired(rc, opts, instances)
+	}
+	if err != nil {
+		lastInstances, ok := rc.lastInstances[groupName]
+		if !opts.keepStaleRegions || !ok {
+			return nil, err
+		}
+		log.Printf("error when getting EC2 data in %v, keeping last known instances: %v\n", rc.region, err)
+		return lastInstances, nil
+	}
+
+	rc.lastInstances[groupName] = instances
+	return instances, nil
+}
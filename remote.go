@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+const defaultHostKeyChecking = "yes"
+
+// remoteHosts copies the rendered config to HAPROXY_REMOTE_HOSTS over scp and
+// runs HAPROXY_REMOTE_RELOAD_COMMAND on each of them over ssh. The files go
+// to the same paths as locally.
+type remoteHosts struct {
+	hosts           []string
+	keyPath         string
+	hostKeyChecking string
+	reloadCommand   string
+	environ         *env
+}
+
+// newRemoteHosts returns nil unless HAPROXY_REMOTE_HOSTS is set.
+func newRemoteHosts(environ *env) (*remoteHosts, error) {
+	hosts := splitList(environ.HaproxyRemoteHosts)
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+	r := &remoteHosts{
+		hosts:           hosts,
+		keyPath:         environ.HaproxyRemoteKeyPath,
+		hostKeyChecking: environ.HaproxyRemoteHostKeyChecking,
+		reloadCommand:   environ.HaproxyRemoteReloadCommand,
+		environ:         environ,
+	}
+	switch r.hostKeyChecking {
+	case "":
+		r.hostKeyChecking = defaultHostKeyChecking
+	case "yes", "no", "accept-new":
+	default:
+		return nil, fmt.Errorf("invalid HAPROXY_REMOTE_HOST_KEY_CHECKING %q, expected yes, no or accept-new", r.hostKeyChecking)
+	}
+	return r, nil
+}
+
+func (r *remoteHosts) sshOptions() []string {
+	options := []string{"-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=" + r.hostKeyChecking}
+	if r.keyPath != "" {
+		options = append(options, "-i", r.keyPath)
+	}
+	return options
+}
+
+// push copies the config files to a host and reloads haproxy there.
+func (r *remoteHosts) push(host string, rc reloadContext) error {
+	for _, t := range haProxyTemplates {
+		args := append(append([]string{"scp"}, r.sshOptions()...), t.dest, host+":"+t.dest)
+		err := runCommand("remote copy", "scp to "+host, args, r.environ.reloadTimeout(), rc)
+		if err != nil {
+			return err
+		}
+	}
+	if r.reloadCommand == "" {
+		return nil
+	}
+	args := append(append([]string{"ssh"}, r.sshOptions()...), host, r.reloadCommand)
+	return runCommand("remote reload", "ssh to "+host, args, r.environ.reloadTimeout(), rc)
+}
+
+// distribute pushes the config to every host in parallel, a failing host
+// doesn't hold up the others. The error reports a partial update.
+func (r *remoteHosts) distribute(rc reloadContext) error {
+	if r == nil {
+		return nil
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []string
+	for _, host := range r.hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			err := r.push(host, rc)
+			if err != nil {
+				log.Printf("error when updating remote host %v: %v\n", host, err)
+				mu.Lock()
+				failed = append(failed, host)
+				mu.Unlock()
+				return
+			}
+			log.Println("updated remote host: ", host)
+		}(host)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("partial update, %d of %d remote hosts failed: %v",
+			len(failed), len(r.hosts), strings.Join(failed, ", "))
+	}
+	return nil
+}
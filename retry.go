@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+const (
+	retryBaseDelay = 200 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
+)
+
+// throttlingErrorCodes are the AWS error codes that are worth retrying.
+// Everything else (e.g. UnauthorizedOperation) fails right away.
+var throttlingErrorCodes = map[string]bool{
+	"RequestLimitExceeded":     true,
+	"Throttling":               true,
+	"ThrottlingException":      true,
+	"RequestThrottled":         true,
+	"TooManyRequestsException": true,
+}
+
+func isThrottlingError(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return throttlingErrorCodes[awsErr.Code()]
+	}
+	return false
+}
+
+// backoffDelay returns the delay before the given retry, using exponential
+// backoff with full jitter.
+func backoffDelay(retry int) time.Duration {
+	delay := retryBaseDelay << uint(retry)
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// retryOnThrottling calls fn until it succeeds, fails with a non throttling
+// error, maxRetries is exhausted or the timeout would be exceeded.
+func retryOnThrottling(maxRetries int, timeout time.Duration, fn func() error) error {
+	deadline := time.Now().Add(timeout)
+	for retry := 0; ; retry++ {
+		err := fn()
+		if err == nil || !isThrottlingError(err) || retry >= maxRetries {
+			return err
+		}
+		delay := backoffDelay(retry)
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		log.Printf("throttled by AWS, retrying in %v: %v\n", delay, err)
+		time.Sleep(delay)
+	}
+}
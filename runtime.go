@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const runtimeSocketTimeout = 5 * time.Second
+
+// errRuntimeUnsupported is returned when the update can't be applied over
+// the runtime socket and haproxy has to be reloaded instead.
+var errRuntimeUnsupported = errors.New("update can't be applied at runtime")
+
+// runtime API replies that mean the command failed
+var runtimeErrorReplies = []string{"No such", "Can't find", "Unknown", "Require", "Invalid", "Permission denied"}
+
+// runtimeSocket talks to haproxy's stats socket, one command per connection.
+// A zero timeout means runtimeSocketTimeout.
+type runtimeSocket struct {
+	path    string
+	timeout time.Duration
+}
+
+// serverSlot is a server of a backend as reported by "show servers state".
+type serverSlot struct {
+	name  string
+	addr  string
+	port  int
+	maint bool
+}
+
+func (s *runtimeSocket) command(cmd string) (string, error) {
+	timeout := s.timeout
+	if timeout == 0 {
+		timeout = runtimeSocketTimeout
+	}
+	conn, err := net.DialTimeout("unix", s.path, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	_, err = fmt.Fprintf(conn, "%s\n", cmd)
+	if err != nil {
+		return "", err
+	}
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	out := strings.TrimSpace(string(reply))
+	for _, prefix := range runtimeErrorReplies {
+		if strings.HasPrefix(out, prefix) {
+			return out, fmt.Errorf("%q failed: %v", cmd, out)
+		}
+	}
+	return out, nil
+}
+
+// serverSlots returns the servers configured in backend.
+func (s *runtimeSocket) serverSlots(backend string) ([]serverSlot, error) {
+	out, err := s.command("show servers state " + backend)
+	if err != nil {
+		return nil, err
+	}
+	return parseServersState(out)
+}
+
+// parseServersState parses the output of "show servers state", looking
+// columns up by the names in its header line.
+func parseServersState(out string) ([]serverSlot, error) {
+	var columns map[string]int
+	var slots []serverSlot
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			columns = map[string]int{}
+			for i, name := range strings.Fields(strings.TrimPrefix(line, "#")) {
+				columns[name] = i
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if columns == nil || len(fields) < len(columns) {
+			// the version line, or a truncated one
+			continue
+		}
+		adminState, _ := strconv.Atoi(fields[columns["srv_admin_state"]])
+		slot := serverSlot{
+			name:  fields[columns["srv_name"]],
+			addr:  fields[columns["srv_addr"]],
+			maint: adminState&srvAdminMaint != 0,
+		}
+		if i, ok := columns["srv_port"]; ok {
+			slot.port, _ = strconv.Atoi(fields[i])
+		}
+		slots = append(slots, slot)
+	}
+	if columns == nil {
+		return nil, fmt.Errorf("unexpected servers state: %q", out)
+	}
+	return slots, scanner.Err()
+}
+
+// runtimeCommands works out the commands that turn the slots of backend into
+// servers. A server keeps the slot it already has, new servers take free
+// slots and slots left over are put in maintenance. errRuntimeUnsupported is
+// returned when there are more servers than slots.
+func runtimeCommands(backend templateBackend, slots []serverSlot) ([]string, error) {
+	if len(backend.Servers) > len(slots) {
+		return nil, errRuntimeUnsupported
+	}
+	assigned := make([]*templateItem, len(slots))
+	var pending []templateItem
+	for _, server := range backend.Servers {
+		found := false
+		for i, slot := range slots {
+			if assigned[i] == nil && slot.addr == server.Host && slot.port == server.Port {
+				server := server
+				assigned[i] = &server
+				found = true
+				break
+			}
+		}
+		if !found {
+			pending = append(pending, server)
+		}
+	}
+	for i := range slots {
+		if len(pending) == 0 {
+			break
+		}
+		if assigned[i] == nil {
+			assigned[i] = &pending[0]
+			pending = pending[1:]
+		}
+	}
+
+	var commands []string
+	for i, slot := range slots {
+		target := fmt.Sprintf("%s/%s", backend.Name, slot.name)
+		server := assigned[i]
+		if server == nil {
+			if !slot.maint {
+				commands = append(commands, "set server "+target+" state maint")
+			}
+			continue
+		}
+		if slot.addr != server.Host || slot.port != server.Port {
+			commands = append(commands, fmt.Sprintf("set server %s addr %s port %d", target, server.Host, server.Port))
+		}
+		commands = append(commands, fmt.Sprintf("set server %s weight %d", target, server.Weight))
+		state := "ready"
+		if server.Disabled {
+			state = "maint"
+		}
+		commands = append(commands, fmt.Sprintf("set server %s state %s", target, state))
+	}
+	return commands, nil
+}
+
+// applyRuntime updates the servers of every backend over the runtime socket.
+// The commands of all backends are worked out before any is sent, so an
+// update that doesn't fit the slots leaves haproxy untouched.
+func applyRuntime(socket *runtimeSocket, data templateData) error {
+	var commands []string
+	for _, backend := range data.Backends {
+		slots, err := socket.serverSlots(backend.Name)
+		if err != nil {
+			log.Println("error when reading servers state: ", err)
+			return errRuntimeUnsupported
+		}
+		backendCommands, err := runtimeCommands(backend, slots)
+		if err != nil {
+			log.Printf("%d servers don't fit in the %d slots of backend %v\n",
+				len(backend.Servers), len(slots), backend.Name)
+			return err
+		}
+		commands = append(commands, backendCommands...)
+	}
+
+	for i, cmd := range commands {
+		_, err := socket.command(cmd)
+		if err != nil {
+			log.Println("error when updating server at runtime: ", err)
+			// the reload that follows overrides them, but they're live until then
+			log.Printf("%d of %d runtime command(s) were applied before the failure: %v\n",
+				i, len(commands), strings.Join(commands[:i], "; "))
+			return err
+		}
+	}
+	log.Printf("applied %d runtime command(s)\n", len(commands))
+	return nil
+}
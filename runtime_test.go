@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testServersStateHeader = "1\n# be_id be_name srv_id srv_name srv_addr srv_op_state srv_admin_state srv_uweight " +
+	"srv_iweight srv_time_since_last_change srv_check_status srv_check_result srv_check_health srv_check_state " +
+	"srv_agent_state bk_f_forced_id srv_f_forced_id srv_fqdn srv_port srvrecord\n"
+
+// fakeRuntimeSocket answers runtime API commands on a unix socket, one
+// command per connection like haproxy's stats socket.
+type fakeRuntimeSocket struct {
+	listener net.Listener
+	reply    func(cmd string) string
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func newFakeRuntimeSocket(t *testing.T, reply func(cmd string) string) *fakeRuntimeSocket {
+	dir, err := ioutil.TempDir("", "runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("unix", filepath.Join(dir, "haproxy.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRuntimeSocket{listener: listener, reply: reply}
+	t.Cleanup(func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	})
+	go f.serve()
+	return f
+}
+
+func (f *fakeRuntimeSocket) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		cmd, err := bufio.NewReader(conn).ReadString('\n')
+		if err == nil {
+			cmd = strings.TrimSpace(cmd)
+			f.mu.Lock()
+			f.commands = append(f.commands, cmd)
+			f.mu.Unlock()
+			conn.Write([]byte(f.reply(cmd) + "\n"))
+		}
+		conn.Close()
+	}
+}
+
+func (f *fakeRuntimeSocket) socket() *runtimeSocket {
+	return &runtimeSocket{path: f.listener.Addr().String()}
+}
+
+// sent returns the commands received, leaving out the state queries.
+func (f *fakeRuntimeSocket) sent() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var commands []string
+	for _, cmd := range f.commands {
+		if !strings.HasPrefix(cmd, "show ") {
+			commands = append(commands, cmd)
+		}
+	}
+	return commands
+}
+
+func TestParseServersState(t *testing.T) {
+	out := testServersStateHeader +
+		"3 web 1 web1 10.0.0.1 2 0 1 1 100 6 3 4 6 0 0 0 - 80 -\n" +
+		"3 web 2 web2 10.0.0.2 0 1 1 1 100 6 3 0 6 0 0 0 - 8080 -\n" +
+		"3 web 3 web3 10.0.0.3 0\n"
+	slots, err := parseServersState(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []serverSlot{
+		{name: "web1", addr: "10.0.0.1", port: 80},
+		{name: "web2", addr: "10.0.0.2", port: 8080, maint: true},
+	}
+	if !reflect.DeepEqual(slots, want) {
+		t.Errorf("parseServersState() = %+v, want %+v", slots, want)
+	}
+
+	_, err = parseServersState("No such backend.")
+	if err == nil {
+		t.Error("parseServersState() accepted output without a header")
+	}
+}
+
+func TestRuntimeCommands(t *testing.T) {
+	slots := []serverSlot{
+		{name: "web1", addr: "10.0.0.1", port: 80},
+		{name: "web2", addr: "10.0.0.2", port: 80},
+		{name: "web3", addr: "0.0.0.0", port: 0, maint: true},
+	}
+	tests := []struct {
+		name    string
+		servers []templateItem
+		want    []string
+		wantErr error
+	}{
+		{
+			name: "servers keep their slot",
+			servers: []templateItem{
+				{Host: "10.0.0.2", Port: 80, Weight: 1},
+				{Host: "10.0.0.1", Port: 80, Weight: 5},
+			},
+			want: []string{
+				"set server web/web1 weight 5",
+				"set server web/web1 state ready",
+				"set server web/web2 weight 1",
+				"set server web/web2 state ready",
+			},
+		},
+		{
+			name: "new server reuses a free slot",
+			servers: []templateItem{
+				{Host: "10.0.0.2", Port: 80, Weight: 1},
+				{Host: "10.0.0.9", Port: 8080, Weight: 1},
+			},
+			want: []string{
+				"set server web/web1 addr 10.0.0.9 port 8080",
+				"set server web/web1 weight 1",
+				"set server web/web1 state ready",
+				"set server web/web2 weight 1",
+				"set server web/web2 state ready",
+			},
+		},
+		{
+			name: "disabled server",
+			servers: []templateItem{
+				{Host: "10.0.0.1", Port: 80, Weight: 1, Disabled: true},
+				{Host: "10.0.0.2", Port: 80, Weight: 1},
+				{Host: "10.0.0.3", Port: 80, Weight: 1},
+			},
+			want: []string{
+				"set server web/web1 weight 1",
+				"set server web/web1 state maint",
+				"set server web/web2 weight 1",
+				"set server web/web2 state ready",
+				"set server web/web3 addr 10.0.0.3 port 80",
+				"set server web/web3 weight 1",
+				"set server web/web3 state ready",
+			},
+		},
+		{
+			name: "more servers than slots",
+			servers: []templateItem{
+				{Host: "10.0.0.1", Port: 80}, {Host: "10.0.0.2", Port: 80},
+				{Host: "10.0.0.3", Port: 80}, {Host: "10.0.0.4", Port: 80},
+			},
+			wantErr: errRuntimeUnsupported,
+		},
+	}
+	for _, tt := range tests {
+		got, err := runtimeCommands(templateBackend{Name: "web", Servers: tt.servers}, slots)
+		if err != tt.wantErr {
+			t.Errorf("%v: runtimeCommands() error = %v, want %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: runtimeCommands() =\n%v\nwant\n%v", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestRuntimeCommandsEmptiesLeftoverSlots(t *testing.T) {
+	slots := []serverSlot{
+		{name: "web1", addr: "10.0.0.1", port: 80},
+		{name: "web2", addr: "10.0.0.2", port: 80},
+	}
+	got, err := runtimeCommands(templateBackend{Name: "web", Servers: []templateItem{{Host: "10.0.0.2", Port: 80, Weight: 1}}}, slots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"set server web/web1 state maint",
+		"set server web/web2 weight 1",
+		"set server web/web2 state ready",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("runtimeCommands() = %v, want %v", got, want)
+	}
+}
+
+func testRuntimeData() templateData {
+	return templateData{Backends: []templateBackend{{
+		Name:    "web",
+		Servers: []templateItem{{Host: "10.0.0.1", Port: 80, Weight: 1}},
+	}}}
+}
+
+func TestApplyRuntime(t *testing.T) {
+	fake := newFakeRuntimeSocket(t, func(cmd string) string {
+		if cmd == "show servers state web" {
+			return testServersStateHeader + "3 web 1 web1 10.0.0.2 2 0 1 1 100 6 3 4 6 0 0 0 - 80 -"
+		}
+		return ""
+	})
+	err := applyRuntime(fake.socket(), testRuntimeData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"set server web/web1 addr 10.0.0.1 port 80",
+		"set server web/web1 weight 1",
+		"set server web/web1 state ready",
+	}
+	if got := fake.sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("applyRuntime() sent %v, want %v", got, want)
+	}
+}
+
+func TestApplyRuntimeFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   func(cmd string) string
+		wantErr error
+		sent    int
+	}{
+		{
+			name:    "unknown backend",
+			reply:   func(cmd string) string { return "Can't find backend." },
+			wantErr: errRuntimeUnsupported,
+		},
+		{
+			name: "no free slot",
+			reply: func(cmd string) string {
+				return strings.TrimSuffix(testServersStateHeader, "\n")
+			},
+			wantErr: errRuntimeUnsupported,
+		},
+		{
+			name: "command fails halfway",
+			reply: func(cmd string) string {
+				if strings.HasPrefix(cmd, "show ") {
+					return testServersStateHeader + "3 web 1 web1 10.0.0.2 2 0 1 1 100 6 3 4 6 0 0 0 - 80 -"
+				}
+				if strings.Contains(cmd, "weight") {
+					return "Require 'operator' level."
+				}
+				return ""
+			},
+			sent: 2,
+		},
+	}
+	for _, tt := range tests {
+		fake := newFakeRuntimeSocket(t, tt.reply)
+		err := applyRuntime(fake.socket(), testRuntimeData())
+		if err == nil {
+			t.Errorf("%v: applyRuntime() succeeded, want an error to fall back to a reload", tt.name)
+			continue
+		}
+		if tt.wantErr != nil && err != tt.wantErr {
+			t.Errorf("%v: applyRuntime() error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if got := len(fake.sent()); got != tt.sent {
+			t.Errorf("%v: applyRuntime() sent %d command(s), want %d", tt.name, got, tt.sent)
+		}
+	}
+}
+
+func TestRuntimeSocketUnavailable(t *testing.T) {
+	socket := &runtimeSocket{path: filepath.Join(os.TempDir(), "missing-haproxy.sock")}
+	err := applyRuntime(socket, testRuntimeData())
+	if err != errRuntimeUnsupported {
+		t.Errorf("applyRuntime() error = %v, want %v", err, errRuntimeUnsupported)
+	}
+}
+
+func TestWaitForRemovedServersMatchesSlotsByAddress(t *testing.T) {
+	fake := newFakeRuntimeSocket(t, func(cmd string) string {
+		switch cmd {
+		case "show servers state web":
+			return testServersStateHeader +
+				"3 web 1 web1 10.0.0.1 2 0 1 1 100 6 3 4 6 0 0 0 - 80 -\n" +
+				"3 web 2 web2 10.0.0.2 2 0 1 1 100 6 3 4 6 0 0 0 - 80 -\n" +
+				"3 web 3 web3 10.0.0.3 2 0 1 1 100 6 3 4 6 0 0 0 - 80 -\n" +
+				"3 web 4 web4 0.0.0.0 0 1 1 1 100 6 3 4 6 0 0 0 - 0 -"
+		case "show stat":
+			return "# pxname,svname,scur\nweb,web1,3\nweb,web2,0\nweb,web3,0\nweb,BACKEND,3"
+		}
+		return ""
+	})
+	data := templateData{Backends: []templateBackend{{
+		Name: "web",
+		Servers: []templateItem{
+			{Name: "web-a", Host: "10.0.0.1", Port: 80, PrivateIP: "10.0.0.1"},
+			{Name: "web-b", Host: "ip-10-0-0-2.ec2.internal", Port: 80, PrivateIP: "10.0.0.2"},
+		},
+	}}}
+	waitForRemovedServers(fake.socket(), data, &env{})
+	want := []string{"set server web/web3 state drain"}
+	if got := fake.sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("waitForRemovedServers() sent %v, want %v", got, want)
+	}
+}
+
+func TestReloadLocalReportsReload(t *testing.T) {
+	reloaded, err := reloadLocal(&configWriter{}, &env{HaproxyNoReload: true}, testRuntimeData(), nil, reloadContext{})
+	if err != nil || reloaded {
+		t.Errorf("reloadLocal() with reloads disabled = %v, %v, want false", reloaded, err)
+	}
+
+	fake := newFakeRuntimeSocket(t, func(cmd string) string {
+		if cmd == "show servers state web" {
+			return testServersStateHeader + "3 web 1 web1 10.0.0.1 2 0 1 1 100 6 3 4 6 0 0 0 - 80 -"
+		}
+		return ""
+	})
+	w := &configWriter{runtime: fake.socket()}
+	reloaded, err = reloadLocal(w, &env{HaproxyReloadCommand: "true"}, testRuntimeData(), nil, reloadContext{})
+	if err != nil || !reloaded {
+		t.Errorf("reloadLocal() at runtime = %v, %v, want true", reloaded, err)
+	}
+}
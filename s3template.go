@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// errTemplateNotModified is returned when the template in S3 still has the
+// ETag it was last fetched with.
+var errTemplateNotModified = errors.New("template not modified")
+
+func isS3URL(path string) bool {
+	return strings.HasPrefix(path, "s3://")
+}
+
+// parseS3URL splits s3://bucket/key into bucket and key.
+func parseS3URL(url string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(url, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid S3 URL %q, expected s3://bucket/key", url)
+	}
+	return parts[0], parts[1], nil
+}
+
+// fetchS3Template downloads the template and returns it with its ETag.
+// Given the ETag of the previous download, errTemplateNotModified is
+// returned when it's unchanged.
+func fetchS3Template(s3Client *s3.S3, url, etag string) (string, string, error) {
+	bucket, key, err := parseS3URL(url)
+	if err != nil {
+		return "", "", err
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if etag != "" {
+		input.IfNoneMatch = aws.String(etag)
+	}
+	output, err := s3Client.GetObject(input)
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotModified {
+		return "", "", errTemplateNotModified
+	}
+	if err != nil {
+		return "", "", err
+	}
+	defer output.Body.Close()
+
+	if etag != "" && aws.StringValue(output.ETag) == etag {
+		return "", "", errTemplateNotModified
+	}
+	body, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return "", "", err
+	}
+	return string(body), aws.StringValue(output.ETag), nil
+}
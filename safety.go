@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+const defaultMinBackendServers = 1
+
+// rejectedUpdates counts the configs refused by the safety checks.
+var rejectedUpdates uint64
+
+// minBackendServers returns how many servers every backend needs for a
+// config to be installed, 0 with ALLOW_EMPTY_BACKENDS.
+func (e *env) minBackendServers() int {
+	if e.AllowEmptyBackends {
+		return 0
+	}
+	if e.MinBackendServers > 0 {
+		return e.MinBackendServers
+	}
+	return defaultMinBackendServers
+}
+
+// checkBackends refuses configs where a backend has fewer servers than
+// MIN_BACKEND_SERVERS, which usually means discovery went wrong rather than
+// the group actually being empty.
+func checkBackends(data templateData, environ *env) error {
+	min := environ.minBackendServers()
+	if len(data.Backends) == 0 && min > 0 {
+		return fmt.Errorf("no backends discovered")
+	}
+	for _, backend := range data.Backends {
+		if len(backend.Servers) < min {
+			return fmt.Errorf("backend %v has %d servers, MIN_BACKEND_SERVERS is %d (set ALLOW_EMPTY_BACKENDS to allow it)",
+				backend.Name, len(backend.Servers), min)
+		}
+	}
+	return nil
+}
+
+// permanentError marks an update error that retrying with the same
+// instances won't fix, e.g. a refused config or a broken template.
+type permanentError struct {
+	error
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// rejectUpdate logs and counts a config refused by a safety check, the
+// current config is kept.
+func rejectUpdate(err error) error {
+	rejected := atomic.AddUint64(&rejectedUpdates, 1)
+	log.Printf("warning: refusing to install config, keeping the current one (%d refused so far): %v\n", rejected, err)
+	return permanentError{err}
+}
+
+// maxRemovalFraction parses MAX_REMOVAL_FRACTION, 0 disables the check.
+func (e *env) maxRemovalFraction() (float64, error) {
+	if e.MaxRemovalFraction == "" {
+		return 0, nil
+	}
+	fraction, err := strconv.ParseFloat(e.MaxRemovalFraction, 64)
+	if err != nil || fraction <= 0 || fraction > 1 {
+		return 0, fmt.Errorf("invalid MAX_REMOVAL_FRACTION %q, expected a number in (0, 1]", e.MaxRemovalFraction)
+	}
+	return fraction, nil
+}
+
+// serverKey identifies a server across configs.
+func serverKey(item templateItem) string {
+	if item.InstanceID != "" {
+		return item.InstanceID
+	}
+	return item.Address
+}
+
+func serverKeys(config map[string][]templateItem) map[string]bool {
+	keys := make(map[string]bool)
+	for groupName, items := range config {
+		for _, item := range items {
+			keys[groupName+"/"+serverKey(item)] = true
+		}
+	}
+	return keys
+}
+
+// checkRemoval refuses a config that drops more than maxFraction of the
+// servers of the last applied one at once, which is more likely an
+// incomplete discovery than a genuine scale-in.
+func checkRemoval(applied, config map[string][]templateItem, maxFraction float64) error {
+	if maxFraction <= 0 || len(applied) == 0 {
+		return nil
+	}
+	before := serverKeys(applied)
+	after := serverKeys(config)
+	if len(before) == 0 {
+		return nil
+	}
+	var removed []string
+	for key := range before {
+		if !after[key] {
+			removed = append(removed, key)
+		}
+	}
+	if float64(len(removed))/float64(len(before)) <= maxFraction {
+		return nil
+	}
+	sort.Strings(removed)
+	return fmt.Errorf("%d of %d servers would be removed, MAX_REMOVAL_FRACTION is %v (send SIGUSR1 to apply anyway): before %v, after %v, removed %v",
+		len(removed), len(before), maxFraction, sortedKeys(before), sortedKeys(after), removed)
+}
+
+func sortedKeys(keys map[string]bool) []string {
+	var sorted []string
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+const (
+	defaultSecretsEnvPrefix = "HAPROXY_SECRET_"
+	// GetParameters takes at most 10 names
+	ssmParametersBatch = 10
+)
+
+// secretValues is the .Secrets map of the template. It doesn't print its
+// values, so logging the template data can't leak them.
+type secretValues map[string]string
+
+func (s secretValues) String() string {
+	return fmt.Sprintf("[%d secrets]", len(s))
+}
+
+// templateSecrets holds the secrets loaded on startup and on SIGHUP.
+var templateSecrets struct {
+	mu     sync.RWMutex
+	values secretValues
+}
+
+// envSecrets holds the secrets read from the environment. The variables are
+// unset once read, so the reload script, hooks and ssh don't inherit them,
+// and SIGHUP reuses the values read on startup.
+var envSecrets struct {
+	once   sync.Once
+	values secretValues
+}
+
+func currentSecrets() secretValues {
+	templateSecrets.mu.RLock()
+	defer templateSecrets.mu.RUnlock()
+	return templateSecrets.values
+}
+
+func (e *env) secretsEnvPrefix() string {
+	if e.HaproxySecretsEnvPrefix != "" {
+		return e.HaproxySecretsEnvPrefix
+	}
+	return defaultSecretsEnvPrefix
+}
+
+// takeEnvSecrets returns the variables starting with prefix, named by the
+// rest of their name, and unsets them.
+func takeEnvSecrets(prefix string) secretValues {
+	values := make(secretValues)
+	for _, pair := range os.Environ() {
+		parts := strings.SplitN(pair, "=", 2)
+		if strings.HasPrefix(parts[0], prefix) && len(parts) == 2 {
+			values[strings.TrimPrefix(parts[0], prefix)] = parts[1]
+			os.Unsetenv(parts[0])
+		}
+	}
+	return values
+}
+
+// loadSecrets reads the secrets from the environment, every variable
+// starting with HAPROXY_SECRETS_ENV_PREFIX named by the rest of its name, and
+// from SSM Parameter Store, HAPROXY_SECRETS_SSM being a comma separated list
+// of name=parameter pairs. A missing parameter is an error, and the secrets
+// in use stay as they are.
+func loadSecrets(environ *env, ssmClient *ssm.SSM) error {
+	envSecrets.once.Do(func() {
+		envSecrets.values = takeEnvSecrets(environ.secretsEnvPrefix())
+	})
+	values := make(secretValues)
+	for name, value := range envSecrets.values {
+		values[name] = value
+	}
+
+	names := make(map[string]string)
+	var parameters []*string
+	for _, pair := range splitList(environ.HaproxySecretsSSM) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid HAPROXY_SECRETS_SSM entry %q, expected name=parameter", pair)
+		}
+		names[parts[1]] = parts[0]
+		parameters = append(parameters, aws.String(parts[1]))
+	}
+	for start := 0; start < len(parameters); start += ssmParametersBatch {
+		end := start + ssmParametersBatch
+		if end > len(parameters) {
+			end = len(parameters)
+		}
+		output, err := ssmClient.GetParameters(&ssm.GetParametersInput{
+			Names:          parameters[start:end],
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			log.Println("error when fetching secrets from SSM: ", err)
+			return err
+		}
+		if len(output.InvalidParameters) > 0 {
+			return fmt.Errorf("SSM parameters not found: %v", strings.Join(aws.StringValueSlice(output.InvalidParameters), ", "))
+		}
+		for _, parameter := range output.Parameters {
+			values[names[aws.StringValue(parameter.Name)]] = aws.StringValue(parameter.Value)
+		}
+	}
+
+	templateSecrets.mu.Lock()
+	defer templateSecrets.mu.Unlock()
+	templateSecrets.values = values
+	log.Printf("loaded %d template secret(s)\n", len(values))
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+const testSecretValue = "fake-stats-password"
+
+func TestTakeEnvSecrets(t *testing.T) {
+	os.Setenv("TEST_SECRET_STATS_PASSWORD", testSecretValue)
+	os.Setenv("TEST_SECRET_EMPTY", "")
+	defer os.Unsetenv("TEST_SECRET_STATS_PASSWORD")
+	defer os.Unsetenv("TEST_SECRET_EMPTY")
+
+	values := takeEnvSecrets("TEST_SECRET_")
+	if values["STATS_PASSWORD"] != testSecretValue {
+		t.Errorf("takeEnvSecrets() = %v, want STATS_PASSWORD", values)
+	}
+	if _, ok := values["EMPTY"]; !ok {
+		t.Errorf("takeEnvSecrets() = %v, want EMPTY", values)
+	}
+	if _, ok := os.LookupEnv("TEST_SECRET_STATS_PASSWORD"); ok {
+		t.Error("takeEnvSecrets() left the variable set")
+	}
+	for _, variable := range (reloadContext{}).environment() {
+		if strings.Contains(variable, testSecretValue) {
+			t.Errorf("reload environment contains the secret: %v", variable)
+		}
+	}
+}
+
+func TestRenderSecrets(t *testing.T) {
+	templateSecrets.mu.Lock()
+	previous := templateSecrets.values
+	templateSecrets.values = secretValues{"STATS_PASSWORD": testSecretValue}
+	templateSecrets.mu.Unlock()
+	defer func() {
+		templateSecrets.mu.Lock()
+		templateSecrets.values = previous
+		templateSecrets.mu.Unlock()
+	}()
+
+	data := testTemplateData()
+	data.Secrets = currentSecrets()
+	tmpl := template.Must(template.New("test").Parse(`stats auth admin:{{ index .Secrets "STATS_PASSWORD" }}`))
+	var out bytes.Buffer
+	err := tmpl.Execute(&out, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "stats auth admin:"+testSecretValue {
+		t.Errorf("rendered %q", out.String())
+	}
+
+	for _, printed := range []string{fmt.Sprint(data), fmt.Sprintf("%v", data.Secrets), fmt.Sprintf("%+v", data)} {
+		if strings.Contains(printed, testSecretValue) {
+			t.Errorf("printed template data contains the secret: %v", printed)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "haproxy.cfg")
+	if mode := configFileMode(path); mode&0007 != 0 {
+		t.Errorf("configFileMode() = %v for a new config with secrets, want no access for others", mode)
+	}
+	err = ioutil.WriteFile(path, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(path, 0644)
+	if mode := configFileMode(path); mode != 0640 {
+		t.Errorf("configFileMode() = %v for an existing config with secrets, want 0640", mode)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signedSNSMsg holds the raw string fields of an SNS message that take part
+// in its signature.
+type signedSNSMsg struct {
+	Type             string
+	MessageId        string
+	TopicArn         string
+	Subject          string
+	Message          string
+	Timestamp        string
+	Token            string
+	SubscribeURL     string
+	SignatureVersion string
+	Signature        string
+	SigningCertURL   string
+}
+
+var snsHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+var signingCertCache = struct {
+	sync.Mutex
+	certs map[string]*x509.Certificate
+}{certs: make(map[string]*x509.Certificate)}
+
+// canonicalString builds the string that SNS signs for the message type.
+func (m *signedSNSMsg) canonicalString() (string, error) {
+	var fields [][2]string
+	switch m.Type {
+	case "Notification":
+		fields = append(fields, [2]string{"Message", m.Message}, [2]string{"MessageId", m.MessageId})
+		if m.Subject != "" {
+			fields = append(fields, [2]string{"Subject", m.Subject})
+		}
+		fields = append(fields,
+			[2]string{"Timestamp", m.Timestamp},
+			[2]string{"TopicArn", m.TopicArn},
+			[2]string{"Type", m.Type})
+	case "SubscriptionConfirmation", "UnsubscribeConfirmation":
+		fields = append(fields,
+			[2]string{"Message", m.Message},
+			[2]string{"MessageId", m.MessageId},
+			[2]string{"SubscribeURL", m.SubscribeURL},
+			[2]string{"Timestamp", m.Timestamp},
+			[2]string{"Token", m.Token},
+			[2]string{"TopicArn", m.TopicArn},
+			[2]string{"Type", m.Type})
+	default:
+		return "", fmt.Errorf("unknown message type %q", m.Type)
+	}
+
+	var canonical strings.Builder
+	for _, field := range fields {
+		canonical.WriteString(field[0] + "\n" + field[1] + "\n")
+	}
+	return canonical.String(), nil
+}
+
+// validateAmazonURL only allows URLs served by AWS over HTTPS, it guards
+// every URL taken from a message before it is requested.
+func validateAmazonURL(rawURL string) error {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if parsedURL.Scheme != "https" {
+		return fmt.Errorf("URL %q is not https", rawURL)
+	}
+	if !strings.HasSuffix(parsedURL.Hostname(), ".amazonaws.com") {
+		return fmt.Errorf("URL %q is not on amazonaws.com", rawURL)
+	}
+	return nil
+}
+
+func getSigningCert(certURL string) (*x509.Certificate, error) {
+	signingCertCache.Lock()
+	defer signingCertCache.Unlock()
+
+	if cert, ok := signingCertCache.certs[certURL]; ok {
+		return cert, nil
+	}
+
+	resp, err := snsHTTPClient.Get(certURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching signing certificate returned %v", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, errors.New("signing certificate is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signingCertCache.certs[certURL] = cert
+	return cert, nil
+}
+
+// confirmSubscription visits the SubscribeURL of a SubscriptionConfirmation,
+// which confirms the subscription of the queue to the topic.
+func confirmSubscription(subscribeURL string) error {
+	err := validateAmazonURL(subscribeURL)
+	if err != nil {
+		return err
+	}
+	resp, err := snsHTTPClient.Get(subscribeURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("confirming subscription returned %v", resp.Status)
+	}
+	return nil
+}
+
+// verifySNSSignature checks the signature of a raw SNS message body against
+// the certificate SNS published it with.
+func verifySNSSignature(body []byte) error {
+	msg := &signedSNSMsg{}
+	err := json.Unmarshal(body, msg)
+	if err != nil {
+		return err
+	}
+
+	var hash crypto.Hash
+	var digest []byte
+	canonical, err := msg.canonicalString()
+	if err != nil {
+		return err
+	}
+	switch msg.SignatureVersion {
+	case "1":
+		sum := sha1.Sum([]byte(canonical))
+		hash, digest = crypto.SHA1, sum[:]
+	case "2":
+		sum := sha256.Sum256([]byte(canonical))
+		hash, digest = crypto.SHA256, sum[:]
+	default:
+		return fmt.Errorf("unsupported signature version %q", msg.SignatureVersion)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return err
+	}
+	err = validateAmazonURL(msg.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	cert, err := getSigningCert(msg.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("signing certificate has no RSA public key")
+	}
+
+	return rsa.VerifyPKCS1v15(publicKey, hash, digest, signature)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	detailTypeSpotInterruption = "EC2 Spot Instance Interruption Warning"
+
+	spotInterruptionRemove  = "remove"
+	spotInterruptionDisable = "disable"
+
+	// interrupted instances are forgotten once they are surely gone
+	spotInterruptionTTL = 10 * time.Minute
+)
+
+// interruptionTracker remembers spot instances that received an
+// interruption warning, so every render removes or disables them until
+// they are terminated.
+type interruptionTracker struct {
+	action string
+
+	mu          sync.Mutex
+	interrupted map[string]time.Time
+}
+
+func newInterruptionTracker(environ *env) (*interruptionTracker, error) {
+	action := environ.SpotInterruptionAction
+	if action == "" {
+		action = spotInterruptionRemove
+	}
+	if action != spotInterruptionRemove && action != spotInterruptionDisable {
+		return nil, fmt.Errorf("invalid SPOT_INTERRUPTION_ACTION %q, expected %q or %q",
+			action, spotInterruptionRemove, spotInterruptionDisable)
+	}
+	return &interruptionTracker{
+		action:      action,
+		interrupted: make(map[string]time.Time),
+	}, nil
+}
+
+func (t *interruptionTracker) add(instanceID string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.interrupted[instanceID] = now
+}
+
+// isInterrupted reports whether the instance received an interruption
+// warning within spotInterruptionTTL.
+func (t *interruptionTracker) isInterrupted(instanceID string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, warnedAt := range t.interrupted {
+		if now.Sub(warnedAt) > spotInterruptionTTL {
+			delete(t.interrupted, id)
+		}
+	}
+	_, ok := t.interrupted[instanceID]
+	return ok
+}
+
+// parseSpotInterruption returns the instance ID of a spot interruption
+// warning.
+func parseSpotInterruption(message string) (string, bool) {
+	event, ok := parseEventBridgeEvent(message)
+	if !ok || event.DetailType != detailTypeSpotInterruption {
+		return "", false
+	}
+	return event.Detail.InstanceID, true
+}
+
+// handleSpotInterruption regenerates the config right away when the message
+// is a spot interruption warning for one of the backend instances. It
+// reports whether the message was a spot interruption warning.
+func (u *configUpdater) handleSpotInterruption(msgBody *snsMsg) (bool, error) {
+	instanceID, ok := parseSpotInterruption(msgBody.Message)
+	if !ok {
+		return false, nil
+	}
+
+	u.mu.Lock()
+	known := false
+	for _, instances := range cachedInstances(u.regionClients, u.groupNames) {
+		for _, instance := range instances {
+			known = known || instance.instanceID == instanceID
+		}
+	}
+	u.mu.Unlock()
+	if !known {
+		log.Println("ignoring spot interruption of unknown instance: ", instanceID)
+		return true, nil
+	}
+
+	log.Printf("spot interruption warning for %v, %v it\n", instanceID, u.opts.interruptions.action)
+	u.opts.interruptions.add(instanceID, time.Now())
+	return true, u.update(false)
+}
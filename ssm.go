@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+const (
+	defaultSSMRetries     = 2
+	defaultSSMTimeout     = 5 * time.Minute
+	ssmPollInterval       = 5 * time.Second
+	ssmConfigURLParameter = "configUrl"
+)
+
+// ssmFleet publishes the config to HAPROXY_PUBLISH_S3_URL and runs the
+// SSM_DOCUMENT_NAME document on the instances tagged SSM_TARGET_TAG, which
+// download it from there and reload haproxy. The document gets the URL as
+// its configUrl parameter. The other files of HAPROXY_RENDER_PAIRS are
+// published next to it under their file name, for the document to fetch
+// from the same prefix. The results are logged per instance.
+type ssmFleet struct {
+	s3Client  *s3.S3
+	ssmClient *ssm.SSM
+	url       string
+	document  string
+	tagKey    string
+	tagValue  string
+	retries   int
+	timeout   time.Duration
+
+	// generationID is the config last sent to the fleet
+	mu           sync.Mutex
+	generationID string
+}
+
+// newSSMFleet returns nil unless SSM_DOCUMENT_NAME is set.
+func newSSMFleet(environ *env, session *session.Session) (*ssmFleet, error) {
+	if environ.SsmDocumentName == "" {
+		return nil, nil
+	}
+	if !isS3URL(environ.HaproxyPublishS3URL) {
+		return nil, fmt.Errorf("SSM_DOCUMENT_NAME requires HAPROXY_PUBLISH_S3_URL as s3://bucket/key")
+	}
+	_, _, err := ssmPublishKeys(environ.HaproxyPublishS3URL, templateDests())
+	if err != nil {
+		return nil, err
+	}
+	tag := strings.SplitN(environ.SsmTargetTag, "=", 2)
+	if len(tag) != 2 || tag[0] == "" {
+		return nil, fmt.Errorf("invalid SSM_TARGET_TAG %q, expected key=value", environ.SsmTargetTag)
+	}
+	f := &ssmFleet{
+		s3Client:  s3.New(session),
+		ssmClient: ssm.New(session),
+		url:       environ.HaproxyPublishS3URL,
+		document:  environ.SsmDocumentName,
+		tagKey:    tag[0],
+		tagValue:  tag[1],
+		retries:   defaultSSMRetries,
+		timeout:   defaultSSMTimeout,
+	}
+	if environ.SsmRetries > 0 {
+		f.retries = environ.SsmRetries
+	}
+	if environ.SsmTimeoutSeconds > 0 {
+		f.timeout = time.Duration(environ.SsmTimeoutSeconds) * time.Second
+	}
+	return f, nil
+}
+
+// templateDests returns the destination of every rendered file, the haproxy
+// config first.
+func templateDests() []string {
+	var dests []string
+	for _, t := range haProxyTemplates {
+		dests = append(dests, t.dest)
+	}
+	return dests
+}
+
+// ssmPublishKeys returns the S3 key of every file in dests. The first one,
+// the haproxy config, goes to url, the others next to it under their file
+// name. Files that would overwrite each other are an error.
+func ssmPublishKeys(url string, dests []string) (string, []string, error) {
+	bucket, key, err := parseS3URL(url)
+	if err != nil {
+		return "", nil, err
+	}
+	keys := make([]string, len(dests))
+	published := make(map[string]string)
+	for i, dest := range dests {
+		keys[i] = key
+		if i > 0 {
+			keys[i] = path.Join(path.Dir(key), filepath.Base(dest))
+		}
+		if other, ok := published[keys[i]]; ok {
+			return "", nil, fmt.Errorf("%v and %v would both be published to s3://%v/%v", other, dest, bucket, keys[i])
+		}
+		published[keys[i]] = dest
+	}
+	return bucket, keys, nil
+}
+
+// publish uploads every rendered file, the haproxy config last, so the
+// files it refers to are in place once it changes.
+func (f *ssmFleet) publish(dests []string) error {
+	bucket, keys, err := ssmPublishKeys(f.url, dests)
+	if err != nil {
+		return err
+	}
+	for i := len(dests) - 1; i >= 0; i-- {
+		content, err := ioutil.ReadFile(dests[i])
+		if err != nil {
+			return err
+		}
+		_, err = f.s3Client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(keys[i]),
+			Body:   bytes.NewReader(content),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update publishes the config and runs the document on the fleet. The
+// invocations are followed in the background, so a slow fleet holds up
+// neither the next update nor the queue.
+func (f *ssmFleet) update(rc reloadContext) error {
+	if f == nil {
+		return nil
+	}
+	err := f.publish(templateDests())
+	if err != nil {
+		log.Println("error when publishing config to S3: ", err)
+		return err
+	}
+	log.Println("published config to: ", f.url)
+
+	commandID, err := f.send(rc, nil)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.generationID = rc.generationID
+	f.mu.Unlock()
+	go f.follow(commandID, rc)
+	return nil
+}
+
+// send runs the document on the given instances, or on every instance with
+// the target tag when there are none.
+func (f *ssmFleet) send(rc reloadContext, instanceIDs []*string) (string, error) {
+	input := &ssm.SendCommandInput{
+		DocumentName: aws.String(f.document),
+		Comment:      aws.String("haproxyconf " + rc.generationID),
+		Parameters:   map[string][]*string{ssmConfigURLParameter: {aws.String(f.url)}},
+	}
+	if len(instanceIDs) > 0 {
+		input.InstanceIds = instanceIDs
+	} else {
+		input.Targets = []*ssm.Target{{
+			Key:    aws.String("tag:" + f.tagKey),
+			Values: []*string{aws.String(f.tagValue)},
+		}}
+	}
+	output, err := f.ssmClient.SendCommand(input)
+	if err != nil {
+		log.Println("error when sending SSM command: ", err)
+		return "", err
+	}
+	return aws.StringValue(output.Command.CommandId), nil
+}
+
+// superseded reports whether a newer config than generationID was sent.
+func (f *ssmFleet) superseded(generationID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.generationID != generationID
+}
+
+// follow waits for the command and runs it again on the instances it failed
+// on, up to SSM_RETRIES times, unless a newer config was sent meanwhile.
+func (f *ssmFleet) follow(commandID string, rc reloadContext) {
+	for attempt := 1; ; attempt++ {
+		failed, err := f.wait(commandID)
+		if err != nil {
+			return
+		}
+		if len(failed) == 0 {
+			log.Printf("SSM command %v for config %v succeeded\n", commandID, rc.generationID)
+			return
+		}
+		if attempt > f.retries {
+			log.Printf("warning: partial update, SSM command for config %v failed on %d instance(s): %v\n",
+				rc.generationID, len(failed), strings.Join(aws.StringValueSlice(failed), ", "))
+			return
+		}
+		if f.superseded(rc.generationID) {
+			log.Printf("newer config sent, not retrying config %v on %d instance(s)\n", rc.generationID, len(failed))
+			return
+		}
+		log.Printf("retrying on %d instance(s), attempt %d of %d\n", len(failed), attempt, f.retries)
+		commandID, err = f.send(rc, failed)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// wait polls the invocations of the command until all of them finished and
+// returns the instances it didn't succeed on.
+func (f *ssmFleet) wait(commandID string) ([]*string, error) {
+	deadline := time.Now().Add(f.timeout)
+	for {
+		time.Sleep(ssmPollInterval)
+		var invocations []*ssm.CommandInvocation
+		err := f.ssmClient.ListCommandInvocationsPages(&ssm.ListCommandInvocationsInput{
+			CommandId: aws.String(commandID),
+		}, func(output *ssm.ListCommandInvocationsOutput, lastPage bool) bool {
+			invocations = append(invocations, output.CommandInvocations...)
+			return true
+		})
+		if err != nil {
+			log.Println("error when listing SSM command invocations: ", err)
+			return nil, err
+		}
+
+		done := len(invocations) > 0
+		for _, invocation := range invocations {
+			switch aws.StringValue(invocation.Status) {
+			case ssm.CommandInvocationStatusPending, ssm.CommandInvocationStatusInProgress, ssm.CommandInvocationStatusDelayed:
+				done = false
+			}
+		}
+		if !done && time.Now().Before(deadline) {
+			continue
+		}
+
+		var failed []*string
+		for _, invocation := range invocations {
+			status := aws.StringValue(invocation.Status)
+			log.Printf("SSM command %v on %v: %v (%v)\n", commandID, aws.StringValue(invocation.InstanceId),
+				status, aws.StringValue(invocation.StatusDetails))
+			if status != ssm.CommandInvocationStatusSuccess {
+				failed = append(failed, invocation.InstanceId)
+			}
+		}
+		if len(invocations) == 0 {
+			log.Printf("SSM command %v found no instances tagged %v=%v\n", commandID, f.tagKey, f.tagValue)
+		}
+		return failed, nil
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSSMPublishKeys(t *testing.T) {
+	bucket, keys, err := ssmPublishKeys("s3://configs/lb/haproxy.cfg",
+		[]string{"/etc/haproxy/haproxy.cfg", "/etc/haproxy/maps/hosts.map", "/etc/haproxy/backends.lst"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"lb/haproxy.cfg", "lb/hosts.map", "lb/backends.lst"}
+	if bucket != "configs" || !reflect.DeepEqual(keys, want) {
+		t.Errorf("ssmPublishKeys() = %v, %v, want configs, %v", bucket, keys, want)
+	}
+
+	_, _, err = ssmPublishKeys("s3://configs/lb/haproxy.cfg", []string{"/etc/haproxy/haproxy.cfg", "/etc/other/haproxy.cfg"})
+	if err == nil {
+		t.Error("ssmPublishKeys() accepted two files published to the same key")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	// haproxy server state file format version
+	stateFileVersion = 1
+
+	srvStateRunning = 2
+	srvAdminReady   = 0
+	srvAdminMaint   = 1
+)
+
+// stateFileKey identifies a server in the state file.
+func stateFileKey(backend, server string) string {
+	return backend + "/" + server
+}
+
+// newServerStateFile renders the servers in the format of haproxy's
+// "show servers state", for "load-server-state-from-file". Only the servers
+// in previous, the ones haproxy already runs, are listed as up; new servers
+// are left out so haproxy checks them before sending them traffic. Disabled
+// servers are put in maintenance. Servers addressed by DNS name are listed
+// with their private IP, haproxy only takes an IP address there, and left out
+// when they have none.
+func newServerStateFile(data templateData, previous map[string]bool) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d\n", stateFileVersion)
+	buf.WriteString("# be_id be_name srv_id srv_name srv_addr srv_op_state srv_admin_state srv_uweight srv_iweight" +
+		" srv_time_since_last_change srv_check_status srv_check_result srv_check_health srv_check_state" +
+		" srv_agent_state bk_f_forced_id srv_f_forced_id srv_fqdn srv_port srvrecord\n")
+	for i, backend := range data.Backends {
+		for _, server := range backend.Servers {
+			if !previous[stateFileKey(backend.Name, server.Name)] {
+				continue
+			}
+			addr := server.Host
+			if net.ParseIP(addr) == nil {
+				addr = server.PrivateIP
+			}
+			if addr == "" {
+				continue
+			}
+			adminState := srvAdminReady
+			if server.Disabled {
+				adminState = srvAdminMaint
+			}
+			fmt.Fprintf(&buf, "%d %s %d %s %s %d %d %d %d 0 6 3 4 6 0 0 0 - %d -\n",
+				i+1, backend.Name, server.ID, server.Name, addr, srvStateRunning, adminState,
+				server.Weight, server.Weight, server.Port)
+		}
+	}
+	return buf.Bytes()
+}
+
+// stateFileServers returns the keys of all servers in data.
+func stateFileServers(data templateData) map[string]bool {
+	servers := make(map[string]bool)
+	for _, backend := range data.Backends {
+		for _, server := range backend.Servers {
+			servers[stateFileKey(backend.Name, server.Name)] = true
+		}
+	}
+	return servers
+}
+
+// readStateFileServers returns the keys of the servers listed in an existing
+// state file, or none when it can't be read.
+func readStateFileServers(path string) map[string]bool {
+	servers := make(map[string]bool)
+	f, err := os.Open(path)
+	if err != nil {
+		return servers
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		servers[stateFileKey(fields[1], fields[3])] = true
+	}
+	return servers
+}
+
+// writeServerStateFile writes the state file for data. The servers of the
+// previous generation are taken from the file already at path on the first
+// write.
+func writeServerStateFile(w *configWriter, path string, data templateData) error {
+	if w.stateServers == nil {
+		w.stateServers = readStateFileServers(path)
+	}
+	err := writeFileAtomic(w, path, newServerStateFile(data, w.stateServers))
+	if err != nil {
+		return err
+	}
+	w.stateServers = stateFileServers(data)
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func stateFileServerLines(content []byte) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n")[2:] {
+		fields := strings.Fields(line)
+		lines = append(lines, strings.Join([]string{fields[1], fields[3], fields[5], fields[6]}, " "))
+	}
+	return lines
+}
+
+func TestServerStateFileOmitsNewServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "haproxy.state")
+	w := &configWriter{ownership: &fileOwnership{uid: -1, gid: -1}}
+
+	data := testTemplateData()
+	data.Backends[0].Servers = data.Backends[0].Servers[:2]
+	err = writeServerStateFile(w, dest, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(dest)
+	if lines := stateFileServerLines(content); len(lines) != 0 {
+		t.Errorf("first generation lists servers as running: %v", lines)
+	}
+
+	err = writeServerStateFile(w, dest, testTemplateData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = ioutil.ReadFile(dest)
+	got := strings.Join(stateFileServerLines(content), ",")
+	want := "web web-1 2 0,web web-2 2 1"
+	if got != want {
+		t.Errorf("state file servers = %v, want %v", got, want)
+	}
+
+	// a restart takes the previous generation from the file on disk
+	w = &configWriter{ownership: &fileOwnership{uid: -1, gid: -1}}
+	err = writeServerStateFile(w, dest, testTemplateData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = ioutil.ReadFile(dest)
+	if got := strings.Join(stateFileServerLines(content), ","); got != want {
+		t.Errorf("state file servers after restart = %v, want %v", got, want)
+	}
+}
+
+func TestServerStateFileAddresses(t *testing.T) {
+	data := templateData{Backends: []templateBackend{{Name: "web", Servers: []templateItem{
+		{Name: "ip", Host: "10.0.0.1", PrivateIP: "10.0.0.1", Port: 80},
+		{Name: "dns", Host: "ip-10-0-0-2.ec2.internal", PrivateIP: "10.0.0.2", Port: 80},
+		{Name: "ipv6", Host: "2001:db8::3", PrivateIP: "10.0.0.3", Port: 80},
+		{Name: "unresolved", Host: "web.example.com", Port: 80},
+	}}}}
+	content := newServerStateFile(data, stateFileServers(data))
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n")[2:] {
+		fields := strings.Fields(line)
+		got = append(got, fields[3]+" "+fields[4])
+	}
+	want := "ip 10.0.0.1,dns 10.0.0.2,ipv6 2001:db8::3"
+	if strings.Join(got, ",") != want {
+		t.Errorf("state file addresses = %v, want %v", strings.Join(got, ","), want)
+	}
+}
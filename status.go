@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// describeInstanceStatusLimit is the maximum number of instance IDs accepted
+// by a single DescribeInstanceStatus call.
+const describeInstanceStatusLimit = 100
+
+func isStatusImpaired(summary *ec2.InstanceStatusSummary) bool {
+	if summary == nil {
+		return false
+	}
+	if aws.StringValue(summary.Status) == ec2.SummaryStatusImpaired {
+		return true
+	}
+	for _, detail := range summary.Details {
+		if aws.StringValue(detail.Name) == "reachability" &&
+			aws.StringValue(detail.Status) == ec2.StatusTypeFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// markImpaired flags instances whose system or instance status checks are
+// impaired, querying the instance status in chunks.
+func markImpaired(rc *regionClient, opts *discoveryOptions, instances []*internalInstance) error {
+	byID := make(map[string]*internalInstance)
+	var instanceIDs []*string
+	for _, instance := range instances {
+		byID[instance.instanceID] = instance
+		instanceIDs = append(instanceIDs, aws.String(instance.instanceID))
+	}
+
+	for start := 0; start < len(instanceIDs); start += describeInstanceStatusLimit {
+		end := start + describeInstanceStatusLimit
+		if end > len(instanceIDs) {
+			end = len(instanceIDs)
+		}
+
+		var output *ec2.DescribeInstanceStatusOutput
+		err := retryOnThrottling(opts.maxRetries, opts.retryTimeout, func() error {
+			var err error
+			output, err = rc.ec2Client.DescribeInstanceStatus(&ec2.DescribeInstanceStatusInput{
+				InstanceIds: instanceIDs[start:end],
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, status := range output.InstanceStatuses {
+			instance, ok := byID[aws.StringValue(status.InstanceId)]
+			if !ok {
+				continue
+			}
+			if isStatusImpaired(status.InstanceStatus) || isStatusImpaired(status.SystemStatus) {
+				log.Printf("instance %v failed its status checks\n", instance.instanceID)
+				instance.impaired = true
+			}
+		}
+	}
+
+	return nil
+}
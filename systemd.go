@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/coreos/go-systemd/dbus"
+)
+
+const (
+	reloadModeScript   = "script"
+	reloadModeSystemd  = "systemd"
+	reloadModeMaster   = "master"
+	defaultSystemdUnit = "haproxy.service"
+)
+
+func (e *env) reloadMode() string {
+	if e.HaproxyReloadMode == "" {
+		return reloadModeScript
+	}
+	return e.HaproxyReloadMode
+}
+
+func (e *env) systemdUnit() string {
+	if e.HaproxySystemdUnit == "" {
+		return defaultSystemdUnit
+	}
+	return e.HaproxySystemdUnit
+}
+
+// reloadSystemd reloads the unit over D-Bus, waits for the job to finish and
+// checks the unit ended up active.
+func reloadSystemd(unit string, timeout time.Duration) error {
+	conn, err := dbus.New()
+	if err != nil {
+		log.Println("error when connecting to systemd: ", err)
+		return err
+	}
+	defer conn.Close()
+
+	log.Println("reloading systemd unit: ", unit)
+	done := make(chan string, 1)
+	_, err = conn.ReloadUnit(unit, "replace", done)
+	if err != nil {
+		log.Println("error when reloading systemd unit: ", err)
+		return err
+	}
+	select {
+	case result := <-done:
+		if result != "done" {
+			return fmt.Errorf("reload of %v finished with %v: %v", unit, result, unitFailure(conn, unit))
+		}
+	case <-time.After(timeout):
+		return fmt.Errorf("reload timed out after %v", timeout)
+	}
+
+	state, err := conn.GetUnitProperty(unit, "ActiveState")
+	if err != nil {
+		log.Println("error when getting state of systemd unit: ", err)
+		return err
+	}
+	activeState, _ := state.Value.Value().(string)
+	if activeState != "active" {
+		return fmt.Errorf("%v is %v after reload: %v", unit, activeState, unitFailure(conn, unit))
+	}
+	log.Printf("reloaded %v, unit is active\n", unit)
+	return nil
+}
+
+// unitFailure returns the Result systemd recorded for the service, e.g.
+// "exit-code" or "timeout".
+func unitFailure(conn *dbus.Conn, unit string) string {
+	result, err := conn.GetUnitTypeProperty(unit, "Service", "Result")
+	if err != nil {
+		return "unknown reason"
+	}
+	reason, _ := result.Value.Value().(string)
+	return "result " + reason
+}
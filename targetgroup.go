@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+)
+
+// targetGroup mirrors the haproxy servers into AWS_TARGET_GROUP_ARN.
+type targetGroup struct {
+	arn    string
+	client elbv2iface.ELBV2API
+}
+
+// newTargetGroup returns nil unless AWS_TARGET_GROUP_ARN is set. The client
+// runs in the region of the ARN.
+func newTargetGroup(environ *env, sess *session.Session) (*targetGroup, error) {
+	arn := environ.AwsTargetGroupArn
+	if arn == "" {
+		return nil, nil
+	}
+	parts := strings.Split(arn, ":")
+	if len(parts) < 6 || parts[3] == "" {
+		return nil, fmt.Errorf("invalid AWS_TARGET_GROUP_ARN %q", arn)
+	}
+	return &targetGroup{
+		arn:    arn,
+		client: elbv2.New(sess.Copy(&aws.Config{Region: aws.String(parts[3])})),
+	}, nil
+}
+
+func targetKey(id string, port int64) string {
+	return fmt.Sprintf("%s:%d", id, port)
+}
+
+// reconcile registers the servers missing from the target group and
+// deregisters the targets that aren't servers anymore. Disabled servers are
+// deregistered.
+func (g *targetGroup) reconcile(servers []templateItem) error {
+	if g == nil {
+		return nil
+	}
+	health, err := g.client.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(g.arn),
+	})
+	if err != nil {
+		log.Println("error when describing target group: ", err)
+		return err
+	}
+	current := make(map[string]*elbv2.TargetDescription)
+	for _, description := range health.TargetHealthDescriptions {
+		// already on its way out
+		if aws.StringValue(description.TargetHealth.State) == elbv2.TargetHealthStateEnumDraining {
+			continue
+		}
+		target := description.Target
+		current[targetKey(aws.StringValue(target.Id), aws.Int64Value(target.Port))] = target
+	}
+
+	var register []*elbv2.TargetDescription
+	desired := make(map[string]bool)
+	for _, server := range servers {
+		if server.Disabled || server.InstanceID == "" {
+			continue
+		}
+		key := targetKey(server.InstanceID, int64(server.Port))
+		desired[key] = true
+		if _, ok := current[key]; !ok {
+			register = append(register, &elbv2.TargetDescription{
+				Id:   aws.String(server.InstanceID),
+				Port: aws.Int64(int64(server.Port)),
+			})
+		}
+	}
+	var deregister []*elbv2.TargetDescription
+	var deregistered []string
+	for key, target := range current {
+		if !desired[key] {
+			deregister = append(deregister, target)
+			deregistered = append(deregistered, key)
+		}
+	}
+
+	if len(register) > 0 {
+		_, err = g.client.RegisterTargets(&elbv2.RegisterTargetsInput{
+			TargetGroupArn: aws.String(g.arn),
+			Targets:        register,
+		})
+		if err != nil {
+			log.Println("error when registering targets: ", err)
+			return err
+		}
+		log.Printf("registered %d target(s) in %v\n", len(register), g.arn)
+	}
+	if len(deregister) > 0 {
+		_, err = g.client.DeregisterTargets(&elbv2.DeregisterTargetsInput{
+			TargetGroupArn: aws.String(g.arn),
+			Targets:        deregister,
+		})
+		if err != nil {
+			log.Println("error when deregistering targets: ", err)
+			return err
+		}
+		log.Printf("deregistered %v from %v, draining for %v seconds\n",
+			strings.Join(deregistered, ", "), g.arn, g.deregistrationDelay())
+	}
+	return nil
+}
+
+// deregistrationDelay returns the deregistration_delay.timeout_seconds of
+// the target group, for the log.
+func (g *targetGroup) deregistrationDelay() string {
+	output, err := g.client.DescribeTargetGroupAttributes(&elbv2.DescribeTargetGroupAttributesInput{
+		TargetGroupArn: aws.String(g.arn),
+	})
+	if err != nil {
+		return "unknown"
+	}
+	for _, attribute := range output.Attributes {
+		if aws.StringValue(attribute.Key) == "deregistration_delay.timeout_seconds" {
+			return aws.StringValue(attribute.Value)
+		}
+	}
+	return "unknown"
+}
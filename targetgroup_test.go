@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+)
+
+type fakeELBV2 struct {
+	elbv2iface.ELBV2API
+	targets      []*elbv2.TargetHealthDescription
+	registered   []string
+	deregistered []string
+}
+
+func (f *fakeELBV2) DescribeTargetHealth(*elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	return &elbv2.DescribeTargetHealthOutput{TargetHealthDescriptions: f.targets}, nil
+}
+
+func (f *fakeELBV2) RegisterTargets(input *elbv2.RegisterTargetsInput) (*elbv2.RegisterTargetsOutput, error) {
+	for _, target := range input.Targets {
+		f.registered = append(f.registered, targetKey(aws.StringValue(target.Id), aws.Int64Value(target.Port)))
+	}
+	return &elbv2.RegisterTargetsOutput{}, nil
+}
+
+func (f *fakeELBV2) DeregisterTargets(input *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error) {
+	for _, target := range input.Targets {
+		f.deregistered = append(f.deregistered, targetKey(aws.StringValue(target.Id), aws.Int64Value(target.Port)))
+	}
+	return &elbv2.DeregisterTargetsOutput{}, nil
+}
+
+func (f *fakeELBV2) DescribeTargetGroupAttributes(*elbv2.DescribeTargetGroupAttributesInput) (*elbv2.DescribeTargetGroupAttributesOutput, error) {
+	return &elbv2.DescribeTargetGroupAttributesOutput{}, nil
+}
+
+func testTarget(id string, port int64, state string) *elbv2.TargetHealthDescription {
+	return &elbv2.TargetHealthDescription{
+		Target:       &elbv2.TargetDescription{Id: aws.String(id), Port: aws.Int64(port)},
+		TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+	}
+}
+
+func TestTargetGroupReconcile(t *testing.T) {
+	tests := []struct {
+		name           string
+		targets        []*elbv2.TargetHealthDescription
+		servers        []templateItem
+		wantRegister   []string
+		wantDeregister []string
+	}{
+		{
+			name:    "register and deregister",
+			targets: []*elbv2.TargetHealthDescription{testTarget("i-1", 80, "healthy"), testTarget("i-2", 80, "healthy")},
+			servers: []templateItem{
+				{InstanceID: "i-1", Port: 80},
+				{InstanceID: "i-3", Port: 80},
+			},
+			wantRegister:   []string{"i-3:80"},
+			wantDeregister: []string{"i-2:80"},
+		},
+		{
+			name:    "port change",
+			targets: []*elbv2.TargetHealthDescription{testTarget("i-1", 80, "healthy")},
+			servers: []templateItem{
+				{InstanceID: "i-1", Port: 8080},
+			},
+			wantRegister:   []string{"i-1:8080"},
+			wantDeregister: []string{"i-1:80"},
+		},
+		{
+			name:    "draining targets are skipped",
+			targets: []*elbv2.TargetHealthDescription{testTarget("i-1", 80, elbv2.TargetHealthStateEnumDraining)},
+			servers: nil,
+		},
+		{
+			name: "draining target coming back is registered",
+			targets: []*elbv2.TargetHealthDescription{
+				testTarget("i-1", 80, elbv2.TargetHealthStateEnumDraining),
+			},
+			servers:      []templateItem{{InstanceID: "i-1", Port: 80}},
+			wantRegister: []string{"i-1:80"},
+		},
+		{
+			name:    "disabled servers are deregistered",
+			targets: []*elbv2.TargetHealthDescription{testTarget("i-1", 80, "healthy"), testTarget("i-2", 80, "healthy")},
+			servers: []templateItem{
+				{InstanceID: "i-1", Port: 80},
+				{InstanceID: "i-2", Port: 80, Disabled: true},
+				{InstanceID: "i-4", Port: 80, Disabled: true},
+			},
+			wantDeregister: []string{"i-2:80"},
+		},
+		{
+			name:    "servers without an instance ID",
+			targets: nil,
+			servers: []templateItem{{Host: "10.0.0.1", Port: 80}},
+		},
+	}
+	for _, tt := range tests {
+		fake := &fakeELBV2{targets: tt.targets}
+		g := &targetGroup{arn: "arn:aws:elasticloadbalancing:us-east-1:123456789012:targetgroup/web/0123", client: fake}
+		err := g.reconcile(tt.servers)
+		if err != nil {
+			t.Errorf("%v: reconcile() error = %v", tt.name, err)
+			continue
+		}
+		sort.Strings(fake.registered)
+		sort.Strings(fake.deregistered)
+		if !reflect.DeepEqual(fake.registered, tt.wantRegister) {
+			t.Errorf("%v: registered %v, want %v", tt.name, fake.registered, tt.wantRegister)
+		}
+		if !reflect.DeepEqual(fake.deregistered, tt.wantDeregister) {
+			t.Errorf("%v: deregistered %v, want %v", tt.name, fake.deregistered, tt.wantDeregister)
+		}
+	}
+}
+
+func TestNewTargetGroupInvalidArn(t *testing.T) {
+	_, err := newTargetGroup(&env{AwsTargetGroupArn: "web"}, nil)
+	if err == nil {
+		t.Error("newTargetGroup() accepted an invalid ARN")
+	}
+}
+
+func TestTargetGroupNil(t *testing.T) {
+	var g *targetGroup
+	if err := g.reconcile([]templateItem{{InstanceID: "i-1", Port: 80}}); err != nil {
+		t.Errorf("reconcile() on a nil target group = %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const defaultTemplatePath = "haproxy.cfg.template"
+
+// defaultTemplate is rendered when the template file doesn't exist, unless
+// HAPROXY_TEMPLATE_REQUIRED is set.
+//
+//go:embed default.cfg.template
+var defaultTemplate string
+
+// renderPair is a template and the file it's rendered to.
+type renderPair struct {
+	Template string `json:"template"`
+	Dest     string `json:"dest"`
+	// fallback allows the built in template when Template doesn't exist
+	fallback bool
+}
+
+// configTemplate is a parsed template and its destination. It's parsed once
+// the env is loaded and again on SIGHUP.
+type configTemplate struct {
+	dest     string
+	funcs    template.FuncMap
+	fallback bool
+	s3Client *s3.S3
+	// strict fails on missing map keys instead of rendering "<no value>",
+	// unknown struct fields always fail
+	strict bool
+
+	mu   sync.RWMutex
+	path string
+	// etag is the S3 ETag of the template, or a hash of a local one
+	etag string
+	tmpl *template.Template
+}
+
+// haProxyTemplates are rendered on every update, the first one is the
+// haproxy config itself.
+var haProxyTemplates []*configTemplate
+
+// templatePath returns HAPROXY_TEMPLATE_PATH as an absolute path, so errors
+// point at the file actually looked up.
+func (e *env) templatePath() string {
+	path := e.HaproxyTemplatePath
+	if path == "" {
+		path = defaultTemplatePath
+	}
+	if isS3URL(path) {
+		return path
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+// renderPairs returns the templates to render, HAPROXY_RENDER_PAIRS or else
+// HAPROXY_TEMPLATE_PATH rendered to HAPROXY_FILE_DEST.
+func (e *env) renderPairs() ([]renderPair, error) {
+	if e.HaproxyRenderPairs == "" {
+		return []renderPair{{
+			Template: e.templatePath(),
+			Dest:     e.HaproxyFileDest,
+			fallback: !e.HaproxyTemplateRequired,
+		}}, nil
+	}
+	var pairs []renderPair
+	err := json.Unmarshal([]byte(e.HaproxyRenderPairs), &pairs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HAPROXY_RENDER_PAIRS: %v", err)
+	}
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("invalid HAPROXY_RENDER_PAIRS: no pairs")
+	}
+	for i, pair := range pairs {
+		if pair.Template == "" || pair.Dest == "" {
+			return nil, fmt.Errorf("invalid HAPROXY_RENDER_PAIRS: pair %d needs a template and a dest", i)
+		}
+		if isS3URL(pair.Template) {
+			continue
+		}
+		abs, err := filepath.Abs(pair.Template)
+		if err == nil {
+			pairs[i].Template = abs
+		}
+	}
+	return pairs, nil
+}
+
+// templateRoot returns the object templates are executed with. Templates
+// written for a bare list of servers get just that with
+// HAPROXY_TEMPLATE_LEGACY_ROOT.
+func (e *env) templateRoot(data templateData) interface{} {
+	return templateRoot(data, e.HaproxyTemplateLegacyRoot)
+}
+
+func templateRoot(data templateData, legacy bool) interface{} {
+	if legacy {
+		return data.Servers
+	}
+	return data
+}
+
+// sampleTemplateData is what templates are executed with on startup, two
+// servers in one backend and a peer, with every field set.
+func sampleTemplateData() templateData {
+	servers := []templateItem{
+		{
+			Name:       "sample-1",
+			ID:         1,
+			InstanceID: "i-00000000000000001",
+			PrivateIP:  "10.0.0.1",
+			PrivateDNS: "ip-10-0-0-1.ec2.internal",
+			Host:       "10.0.0.1",
+			Port:       defaultPort,
+			Address:    "10.0.0.1:80",
+			Weight:     defaultWeight,
+			Healthy:    true,
+			AZ:         "us-east-1a",
+			Service:    defaultServiceName,
+			Tags:       map[string]string{"Name": "sample-1"},
+		},
+		{
+			Name:       "sample-2",
+			ID:         2,
+			InstanceID: "i-00000000000000002",
+			PrivateIP:  "10.0.1.1",
+			PrivateDNS: "ip-10-0-1-1.ec2.internal",
+			Host:       "10.0.1.1",
+			Port:       defaultPort,
+			Address:    "10.0.1.1:80",
+			Weight:     defaultWeight,
+			Disabled:   true,
+			Healthy:    true,
+			AZ:         "us-east-1b",
+			Backup:     true,
+			Service:    defaultServiceName,
+			Tags:       map[string]string{"Name": "sample-2"},
+		},
+	}
+	return templateData{
+		GeneratedAt: time.Now().UTC(),
+		Group:       "sample",
+		Servers:     servers,
+		Count:       len(servers),
+		Backends: []templateBackend{
+			{Name: "sample", Service: defaultServiceName, Servers: servers},
+		},
+		Peers: []templatePeer{
+			{Name: "sample-peer-1", Host: "10.0.2.1", Port: defaultPeersPort, Local: true},
+		},
+		Secrets: currentSecrets(),
+	}
+}
+
+// selfTestTemplates executes every template against sample data, so
+// templates that parse but fail to execute are caught on startup rather
+// than by the first notification.
+func selfTestTemplates(environ *env) error {
+	data := environ.templateRoot(sampleTemplateData())
+	for _, t := range haProxyTemplates {
+		err := t.Execute(ioutil.Discard, data)
+		if err != nil {
+			return fmt.Errorf("template self-test failed for %v: %v", t.dest, err)
+		}
+	}
+	return nil
+}
+
+// loadTemplates parses the template of every pair with the given helpers.
+// Templates given as s3:// URLs are downloaded with s3Client.
+func loadTemplates(pairs []renderPair, funcs template.FuncMap, strict bool, s3Client *s3.S3) ([]*configTemplate, error) {
+	var templates []*configTemplate
+	for _, pair := range pairs {
+		t := &configTemplate{dest: pair.Dest, funcs: funcs, fallback: pair.fallback, strict: strict, s3Client: s3Client}
+		_, err := t.load(pair.Template)
+		if err != nil {
+			return nil, fmt.Errorf("error when parsing template %v: %v", pair.Template, err)
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// reloadTemplates re-parses every template, a template that fails to parse
+// stays at its previous version. It reports whether any template changed.
+func reloadTemplates() (bool, error) {
+	var firstErr error
+	changed := false
+	for _, t := range haProxyTemplates {
+		templateChanged, err := t.reload()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		changed = changed || templateChanged
+	}
+	return changed, firstErr
+}
+
+// load parses the template at path, failing on unknown functions. On error
+// the previously parsed template stays in use. It reports whether the
+// template was parsed, an S3 template with an unchanged ETag or a local one
+// with unchanged content isn't.
+func (t *configTemplate) load(path string) (bool, error) {
+	t.mu.RLock()
+	etag := t.etag
+	if path != t.path {
+		etag = ""
+	}
+	t.mu.RUnlock()
+
+	var text string
+	var err error
+	if isS3URL(path) {
+		text, etag, err = fetchS3Template(t.s3Client, path, etag)
+		if err == errTemplateNotModified {
+			return false, nil
+		}
+	} else {
+		_, statErr := os.Stat(path)
+		builtIn := os.IsNotExist(statErr) && t.fallback
+		if builtIn {
+			text = defaultTemplate
+		} else {
+			var content []byte
+			content, err = ioutil.ReadFile(path)
+			text = string(content)
+		}
+		hash := fmt.Sprintf("%x", sha256.Sum256([]byte(text)))
+		if err == nil && hash == etag {
+			return false, nil
+		}
+		if builtIn {
+			log.Printf("no template found at %v, using the built in one\n", path)
+		}
+		etag = hash
+	}
+	if err != nil {
+		return false, err
+	}
+
+	tmpl, err := template.New(filepath.Base(path)).Funcs(t.funcs).Parse(text)
+	if err != nil {
+		return false, err
+	}
+	if t.strict {
+		tmpl.Option("missingkey=error")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.path = path
+	t.etag = etag
+	t.tmpl = tmpl
+	return true, nil
+}
+
+func (t *configTemplate) reload() (bool, error) {
+	t.mu.RLock()
+	path := t.path
+	t.mu.RUnlock()
+	return t.load(path)
+}
+
+func (t *configTemplate) Execute(w io.Writer, data interface{}) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tmpl.Execute(w, data)
+}
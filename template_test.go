@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// testTemplateData has a server of every kind: a plain one, a disabled
+// backup and one with weight 0.
+func testTemplateData() templateData {
+	servers := []templateItem{
+		{Name: "web-1", ID: 1, InstanceID: "i-1", Host: "10.0.0.1", Port: 80, Address: "10.0.0.1:80", Weight: 10,
+			WeightSet: true},
+		{Name: "web-2", ID: 2, InstanceID: "i-2", Host: "10.0.0.2", Port: 80, Address: "10.0.0.2:80", Weight: 1,
+			WeightSet: true, Disabled: true, Backup: true},
+		{Name: "web-3", ID: 3, InstanceID: "i-3", Host: "10.0.0.3", Port: 80, Address: "10.0.0.3:80",
+			WeightSet: true},
+	}
+	return templateData{
+		GeneratedAt: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Group:       "web",
+		Servers:     servers,
+		Count:       len(servers),
+		Backends: []templateBackend{
+			{Name: "web", Service: defaultServiceName, Servers: servers},
+			{Name: "empty", Service: defaultServiceName},
+		},
+	}
+}
+
+func renderTestTemplate(t *testing.T, path string, data templateData) string {
+	templates, err := loadTemplates([]renderPair{{Template: path, Dest: "/dev/null"}}, templateFuncs(&env{}), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = templates[0].Execute(&out, data)
+	if err != nil {
+		t.Fatalf("error when rendering %v: %v", path, err)
+	}
+	return out.String()
+}
+
+func assertLines(t *testing.T, rendered string, want, unwanted []string) {
+	for _, line := range want {
+		if !strings.Contains(rendered, line) {
+			t.Errorf("rendered config is missing %q:\n%v", line, rendered)
+		}
+	}
+	for _, line := range unwanted {
+		if strings.Contains(rendered, line) {
+			t.Errorf("rendered config contains %q:\n%v", line, rendered)
+		}
+	}
+}
+
+func TestRenderHaproxyTemplate(t *testing.T) {
+	rendered := renderTestTemplate(t, "haproxy.cfg.template", testTemplateData())
+	assertLines(t, rendered, []string{
+		"backend web\n",
+		"backend empty\n",
+		"# from web, 3 servers in total",
+		"server web-1 10.0.0.1:80 weight 10 check\n",
+		"server web-2 10.0.0.2:80 weight 1 check disabled backup\n",
+		"server web-3 10.0.0.3:80 weight 0 check\n",
+	}, nil)
+}
+
+func TestRenderNginxTemplate(t *testing.T) {
+	rendered := renderTestTemplate(t, "nginx.conf.template", testTemplateData())
+	assertLines(t, rendered, []string{
+		"upstream web {\n",
+		"server 10.0.0.1:80 weight=10;  # web-1\n",
+		"server 10.0.0.2:80 weight=1 down;  # web-2\n",
+		"server 10.0.0.3:80 down;  # web-3\n",
+		"upstream empty {\n        # no servers, nginx needs at least one\n        server 127.0.0.1:1 down;\n}",
+	}, []string{
+		"weight=0",
+		"backend ",
+	})
+}
+
+func TestRenderSampleData(t *testing.T) {
+	for _, path := range []string{"haproxy.cfg.template", "nginx.conf.template", "default.cfg.template"} {
+		renderTestTemplate(t, path, sampleTemplateData())
+	}
+	// no weight configured, existing configs render unchanged
+	rendered := renderTestTemplate(t, "haproxy.cfg.template", sampleTemplateData())
+	assertLines(t, rendered, []string{"server sample-1 10.0.0.1:80 check\n"}, []string{"weight"})
+}
+
+func TestTemplateRootShapes(t *testing.T) {
+	data := testTemplateData()
+	tests := []struct {
+		legacy bool
+		text   string
+		want   string
+	}{
+		{false, `{{ .Group }} {{ .Count }} {{ .GeneratedAt.Format "2006-01-02" }}{{ range .Servers }} {{ .Name }}{{ end }}`,
+			"web 3 2020-01-02 web-1 web-2 web-3"},
+		{false, `{{ range .Backends }}{{ .Name }}:{{ len .Servers }} {{ end }}`, "web:3 empty:0 "},
+		{true, `{{ len . }}{{ range . }} {{ .Name }}{{ end }}`, "3 web-1 web-2 web-3"},
+	}
+	for _, tt := range tests {
+		tmpl := template.Must(template.New("test").Parse(tt.text))
+		var out bytes.Buffer
+		err := tmpl.Execute(&out, (&env{HaproxyTemplateLegacyRoot: tt.legacy}).templateRoot(data))
+		if err != nil {
+			t.Errorf("legacy root %v: rendering %q failed: %v", tt.legacy, tt.text, err)
+			continue
+		}
+		if out.String() != tt.want {
+			t.Errorf("legacy root %v: rendered %q, want %q", tt.legacy, out.String(), tt.want)
+		}
+	}
+}
+
+func TestLegacyTemplateFailsWithNewRoot(t *testing.T) {
+	tmpl := template.Must(template.New("test").Parse(`{{ range . }}{{ .Name }}{{ end }}`))
+	err := tmpl.Execute(ioutil.Discard, (&env{}).templateRoot(testTemplateData()))
+	if err == nil {
+		t.Error("a template ranging over the root rendered with the struct root")
+	}
+}
+
+func TestReloadUnchangedLocalTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "haproxy.cfg.template")
+	ioutil.WriteFile(path, []byte("{{ .Group }}\n"), 0644)
+
+	templates, err := loadTemplates([]renderPair{{Template: path, Dest: "/dev/null"}}, templateFuncs(&env{}), false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := templates[0].reload()
+	if err != nil || changed {
+		t.Errorf("reload() of an unchanged template = %v, %v, want false", changed, err)
+	}
+
+	ioutil.WriteFile(path, []byte("{{ .Group }} {{ .Count }}\n"), 0644)
+	changed, err = templates[0].reload()
+	if err != nil || !changed {
+		t.Errorf("reload() of a changed template = %v, %v, want true", changed, err)
+	}
+	var out bytes.Buffer
+	templates[0].Execute(&out, testTemplateData())
+	if out.String() != "web 3\n" {
+		t.Errorf("rendered %q after reload, want %q", out.String(), "web 3\n")
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDebounceQuiet    = 5 * time.Second
+	defaultDebounceMaxDelay = 30 * time.Second
+	debounceRetryBaseDelay  = 5 * time.Second
+	debounceRetryMaxDelay   = 5 * time.Minute
+)
+
+// configUpdater owns the discovery state and serializes every regeneration
+// of the haproxy config, whether it's triggered by a message, the debounce
+// timer or the end of a warm-up window.
+type configUpdater struct {
+	mu            sync.Mutex
+	regionClients []*regionClient
+	opts          *discoveryOptions
+	environ       *env
+	groupNames    []string
+	deduper       *messageDeduper
+	debounce      *debouncer
+	rawDelivery   string
+	writer        *configWriter
+	targetGroup   *targetGroup
+
+	// waiting counts the updates blocked on mu
+	waiting int32
+
+	// lastApplied is when haproxy was last reloaded or updated at runtime,
+	// updates within HAPROXY_MIN_RELOAD_INTERVAL_SECONDS of it are deferred
+	// to deferTimer
+	lastApplied  time.Time
+	deferTimer   *time.Timer
+	deferredFull bool
+	// addressRetries counts the updates deferred in a row for instances
+	// that don't have an address yet
+	addressRetries int
+
+	// lastConfig is the config haproxy was last reloaded with
+	lastConfig map[string][]templateItem
+	// rerenderPending renders the next update even if it's unchanged
+	rerenderPending bool
+	// maxRemoval is the MAX_REMOVAL_FRACTION, forceNext skips it once
+	maxRemoval float64
+	forceNext  bool
+	// canary holds back servers that aren't reachable yet
+	canary *canaryCheck
+	// lifecycles are the lifecycle actions waiting for their instance to be
+	// removed from the applied config
+	lifecycles []*lifecycleNotification
+
+	// triggers describes the messages handled since the last update
+	triggerMu sync.Mutex
+	triggers  []string
+
+	// holds counts the consumers draining a backlog, updates requested
+	// meanwhile are merged into one that runs once the last one is done
+	holdMu     sync.Mutex
+	holds      int
+	heldUpdate bool
+	heldFull   bool
+}
+
+func newConfigUpdater(regionClients []*regionClient, opts *discoveryOptions, environ *env) *configUpdater {
+	u := &configUpdater{
+		regionClients: regionClients,
+		opts:          opts,
+		environ:       environ,
+		groupNames:    environ.discoveryGroups(),
+		deduper:       newMessageDeduper(environ),
+	}
+	u.debounce = newDebouncer(environ, u.update)
+	return u
+}
+
+// update regenerates the config and reloads haproxy. Unless full is set the
+// cached instance lists are used when they are available. Lifecycle actions
+// waiting for the update are completed once it's really applied.
+func (u *configUpdater) update(full bool) error {
+	atomic.AddInt32(&u.waiting, 1)
+	u.mu.Lock()
+	atomic.AddInt32(&u.waiting, -1)
+
+	deferred, err := u.updateLocked(full)
+	var settled []*lifecycleNotification
+	if !deferred {
+		settled = u.settledLifecycleActions(err)
+	}
+	u.mu.Unlock()
+
+	for _, notification := range settled {
+		u.completeLifecycleAction(notification, err)
+	}
+	return err
+}
+
+// updateLocked does the update with mu held. deferred is set when it was
+// left to a later update instead of being applied.
+func (u *configUpdater) updateLocked(full bool) (deferred bool, err error) {
+	if wait := u.reloadWait(); wait > 0 {
+		u.deferUpdate(full, wait, "reloaded recently")
+		return true, nil
+	}
+
+	var config map[string][]templateItem
+	if full || !cacheReady(u.regionClients, u.groupNames) {
+		config, err = getEC2Config(u.regionClients, u.opts, u.groupNames)
+		if err != nil {
+			return false, err
+		}
+		missing := missingAddresses(u.regionClients)
+		if missing > 0 && u.addressRetries+1 < u.opts.addressRetryAttempts {
+			u.addressRetries++
+			u.deferUpdate(true, u.opts.addressRetryInterval,
+				fmt.Sprintf("%d instance(s) without an address yet", missing))
+			return true, nil
+		}
+		u.addressRetries = 0
+	} else {
+		config = newEC2Config(cachedInstances(u.regionClients, u.groupNames), u.opts, u.groupNames)
+	}
+
+	if !u.environ.HaproxyAlwaysReload && !u.rerenderPending && reflect.DeepEqual(config, u.lastConfig) {
+		log.Println("config unchanged, skipping reload")
+		return false, nil
+	}
+	held := false
+	if !u.forceNext {
+		lastServers := u.opts.withoutPeers(u.lastConfig)
+		err = checkRemoval(lastServers, u.opts.withoutPeers(config), u.maxRemoval)
+		if err != nil {
+			return false, rejectUpdate(err)
+		}
+		peers, ok := config[u.opts.peersGroupName]
+		config, held = u.canary.filter(lastServers, u.opts.withoutPeers(config))
+		if ok {
+			config[u.opts.peersGroupName] = peers
+		}
+	}
+	reloaded, err := applyConfig(u.writer, u.opts, u.groupNames, config, u.environ, u.takeTriggers())
+	if err != nil {
+		return false, err
+	}
+	if held {
+		u.canary.retry(u.retryCanary)
+	}
+	u.lastConfig = config
+	if reloaded {
+		u.lastApplied = time.Now()
+	}
+	u.rerenderPending = false
+	u.forceNext = false
+
+	var servers []templateItem
+	for _, groupName := range u.opts.backendGroups(u.groupNames) {
+		servers = append(servers, config[groupName]...)
+	}
+	err = u.targetGroup.reconcile(servers)
+	if err != nil {
+		// haproxy is updated either way
+		log.Println("error when updating target group: ", err)
+	}
+	return false, nil
+}
+
+// retryCanary runs a full update for the servers the canary check held
+// back.
+func (u *configUpdater) retryCanary() {
+	u.mu.Lock()
+	u.canary.timer = nil
+	u.mu.Unlock()
+
+	err := u.update(true)
+	if err != nil {
+		log.Println("error when retrying held back servers: ", err)
+	}
+}
+
+// reloadWait returns how much longer updates have to wait to keep reloads
+// HAPROXY_MIN_RELOAD_INTERVAL_SECONDS apart.
+func (u *configUpdater) reloadWait() time.Duration {
+	interval := time.Duration(u.environ.HaproxyMinReloadIntervalSeconds) * time.Second
+	if interval <= 0 || u.lastApplied.IsZero() {
+		return 0
+	}
+	return interval - time.Since(u.lastApplied)
+}
+
+// deferUpdate schedules the update to run after wait. Updates deferred in
+// the meantime are merged into the scheduled one. Must be called with mu
+// held.
+func (u *configUpdater) deferUpdate(full bool, wait time.Duration, reason string) {
+	u.deferredFull = u.deferredFull || full
+	if u.deferTimer != nil {
+		return
+	}
+	log.Printf("%v, holding back update for %v\n", reason, wait.Round(time.Second))
+	u.deferTimer = time.AfterFunc(wait, func() {
+		u.mu.Lock()
+		full := u.deferredFull
+		u.deferTimer = nil
+		u.deferredFull = false
+		u.mu.Unlock()
+
+		err := u.update(full)
+		if err != nil {
+			log.Println("error when applying deferred update: ", err)
+		}
+	})
+}
+
+// superseded reports whether another update is waiting to run.
+func (u *configUpdater) superseded() bool {
+	return atomic.LoadInt32(&u.waiting) > 0
+}
+
+// addTrigger records a message that requested an update, for the
+// provenance header of the config.
+func (u *configUpdater) addTrigger(trigger string) {
+	u.triggerMu.Lock()
+	defer u.triggerMu.Unlock()
+
+	u.triggers = append(u.triggers, trigger)
+}
+
+// takeTriggers returns the recorded triggers and clears them. Updates that
+// aren't triggered by a message are syncs.
+func (u *configUpdater) takeTriggers() string {
+	u.triggerMu.Lock()
+	defer u.triggerMu.Unlock()
+
+	if len(u.triggers) == 0 {
+		return "sync"
+	}
+	trigger := strings.Join(u.triggers, ", ")
+	u.triggers = nil
+	return trigger
+}
+
+// force runs a full update that skips the removal check, for a genuine
+// mass scale-in.
+func (u *configUpdater) force() error {
+	u.mu.Lock()
+	u.forceNext = true
+	u.mu.Unlock()
+	return u.update(true)
+}
+
+// rerender regenerates the config even if the instances are unchanged, e.g.
+// after the template was re-parsed.
+func (u *configUpdater) rerender() error {
+	u.mu.Lock()
+	u.rerenderPending = true
+	u.mu.Unlock()
+	return u.update(false)
+}
+
+// syncLoop runs a full discovery every interval until ctx is canceled, so
+// the config converges even when notifications are lost.
+func (u *configUpdater) syncLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := u.update(true)
+		if err != nil {
+			log.Println("error when syncing config: ", err)
+		}
+	}
+}
+
+// templateLoop re-parses the templates every interval until ctx is canceled
+// and re-renders the config when one of them changed.
+func (u *configUpdater) templateLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		changed, err := reloadTemplates()
+		if err != nil {
+			log.Println("error when re-parsing template, keeping the current one: ", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		log.Println("template changed, re-rendering config")
+		err = u.rerender()
+		if err != nil {
+			log.Println("error when re-rendering config: ", err)
+		}
+	}
+}
+
+// requestUpdate runs the update right away, or leaves it to the debouncer
+// when debouncing is enabled.
+func (u *configUpdater) requestUpdate(full bool) error {
+	if u.held(full) {
+		return nil
+	}
+	if u.debounce.enabled() {
+		u.debounce.mark(full)
+		return nil
+	}
+	return u.update(full)
+}
+
+// held records the update request when updates are on hold.
+func (u *configUpdater) held(full bool) bool {
+	u.holdMu.Lock()
+	defer u.holdMu.Unlock()
+
+	if u.holds == 0 {
+		return false
+	}
+	u.heldUpdate = true
+	u.heldFull = u.heldFull || full
+	return true
+}
+
+// hold defers update requests until release is called.
+func (u *configUpdater) hold() {
+	u.holdMu.Lock()
+	defer u.holdMu.Unlock()
+
+	u.holds++
+}
+
+// release ends a hold and runs the updates requested meanwhile as one.
+func (u *configUpdater) release() error {
+	u.holdMu.Lock()
+	u.holds--
+	pending := u.holds == 0 && u.heldUpdate
+	full := u.heldFull
+	if pending {
+		u.heldUpdate = false
+		u.heldFull = false
+	}
+	u.holdMu.Unlock()
+
+	if !pending {
+		return nil
+	}
+	return u.requestUpdate(full)
+}
+
+// applyNotification updates the cached instances from a notification and
+// reports whether that was possible without a full discovery.
+func (u *configUpdater) applyNotification(msgBody *snsMsg) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return applyNotification(u.regionClients, u.opts, u.groupNames, msgBody)
+}
+
+// debouncer collapses bursts of update requests into a single run, started
+// once no request arrived for the quiet period, or at the latest maxDelay
+// after the first request of the burst.
+type debouncer struct {
+	quiet    time.Duration
+	maxDelay time.Duration
+	run      func(full bool) error
+	trigger  chan struct{}
+
+	mu   sync.Mutex
+	full bool
+}
+
+func newDebouncer(environ *env, run func(full bool) error) *debouncer {
+	d := &debouncer{
+		quiet:    defaultDebounceQuiet,
+		maxDelay: defaultDebounceMaxDelay,
+		run:      run,
+		trigger:  make(chan struct{}, 1),
+	}
+	// a negative value turns debouncing off
+	if environ.HaproxyDebounceSeconds < 0 {
+		d.quiet = 0
+	} else if environ.HaproxyDebounceSeconds > 0 {
+		d.quiet = time.Duration(environ.HaproxyDebounceSeconds) * time.Second
+	}
+	if environ.HaproxyDebounceMaxSeconds > 0 {
+		d.maxDelay = time.Duration(environ.HaproxyDebounceMaxSeconds) * time.Second
+	}
+	if d.maxDelay < d.quiet {
+		d.maxDelay = d.quiet
+	}
+	return d
+}
+
+func (d *debouncer) enabled() bool {
+	return d.quiet > 0
+}
+
+// mark requests a run, full asks for a full discovery instead of the cache.
+func (d *debouncer) mark(full bool) {
+	d.mu.Lock()
+	d.full = d.full || full
+	d.mu.Unlock()
+
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// retryDelay returns the delay before retrying a failed run, doubling with
+// every consecutive failure.
+func retryDelay(failures int) time.Duration {
+	delay := debounceRetryBaseDelay << uint(failures)
+	if delay <= 0 || delay > debounceRetryMaxDelay {
+		delay = debounceRetryMaxDelay
+	}
+	return delay
+}
+
+// loop runs the debounced updates. A failed run is retried with exponential
+// backoff, unless retrying can't fix it, in which case it waits for the next
+// request.
+func (d *debouncer) loop() {
+	var retry *time.Timer
+	failures := 0
+	for range d.trigger {
+		deadline := time.Now().Add(d.maxDelay)
+		for {
+			wait := d.quiet
+			if remaining := time.Until(deadline); remaining < wait {
+				wait = remaining
+			}
+			select {
+			case <-d.trigger:
+				continue
+			case <-time.After(wait):
+			}
+			break
+		}
+
+		d.mu.Lock()
+		full := d.full
+		d.full = false
+		d.mu.Unlock()
+
+		if retry != nil {
+			retry.Stop()
+			retry = nil
+		}
+		err := d.run(full)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if isPermanent(err) {
+			log.Println("error when updating config, not retrying until the next update: ", err)
+			failures = 0
+			continue
+		}
+		delay := retryDelay(failures)
+		failures++
+		log.Printf("error when updating config, retrying in %v: %v\n", delay, err)
+		retry = time.AfterFunc(delay, func() {
+			d.mark(true)
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// warmupTracker excludes freshly launched instances and remembers when the
+// earliest of them is ready, so the config can be re-rendered then.
+type warmupTracker struct {
+	duration time.Duration
+
+	mu      sync.Mutex
+	readyAt time.Time
+}
+
+func newWarmupTracker(environ *env) *warmupTracker {
+	return &warmupTracker{
+		duration: time.Duration(environ.AwsInstanceWarmupSeconds) * time.Second,
+	}
+}
+
+// isWarmingUp reports whether the instance is still within its warm-up
+// window and schedules a re-render for when it ends.
+func (w *warmupTracker) isWarmingUp(instance *internalInstance, now time.Time) bool {
+	if w.duration <= 0 || instance.launchTime.IsZero() {
+		return false
+	}
+	readyAt := instance.launchTime.Add(w.duration)
+	if !now.Before(readyAt) {
+		return false
+	}
+	log.Printf("skipping instance %v: warming up for another %v\n",
+		instance.instanceID, readyAt.Sub(now).Round(time.Second))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.readyAt.IsZero() || readyAt.Before(w.readyAt) {
+		w.readyAt = readyAt
+	}
+	return true
+}
+
+// due reports whether a scheduled re-render should happen now and clears it.
+func (w *warmupTracker) due(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.readyAt.IsZero() || now.Before(w.readyAt) {
+		return false
+	}
+	w.readyAt = time.Time{}
+	return true
+}